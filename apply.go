@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+type applyOpt struct {
+	File         string
+	DryRun       bool
+	IdentityFile string
+
+	ctx *Context
+}
+
+// accessState is the desired state of users, groups and owners of secrets
+// read by `agec apply`.
+type accessState struct {
+	Users   []User          `yaml:"users"`
+	Groups  []Group         `yaml:"groups"`
+	Secrets []OwnershipRule `yaml:"secrets"`
+}
+
+func readAccessState(name string) (*accessState, error) {
+	var b []byte
+	var err error
+	if name == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &accessState{}
+	if err := yaml.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", name, err)
+	}
+	return state, nil
+}
+
+// desiredConfig returns a copy of the current config with users, groups and
+// owners of secrets replaced by the desired state.
+func desiredConfig(ctx *Context, state *accessState) (*Config, error) {
+	cfg, err := ctx.Config.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	users := lo.Map(state.Users, func(u User, _ int) string { return u.Name })
+	groups := lo.Map(state.Groups, func(g Group, _ int) string { return g.Name })
+
+	for _, u := range ctx.Config.Users {
+		if !lo.Contains(users, u.Name) {
+			if err := cfg.RemoveUser(u.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, g := range ctx.Config.Groups {
+		if !lo.Contains(groups, g.Name) {
+			if err := cfg.RemoveGroup(g.Name); err != nil {
+				return nil, err
+			}
+			for si := range cfg.Secrets {
+				cfg.Secrets[si].Groups = lo.Filter(cfg.Secrets[si].Groups, func(v string, _ int) bool {
+					return v != g.Name
+				})
+			}
+		}
+	}
+
+	var keys []string
+	for _, du := range state.Users {
+		u, err := desiredUser(ctx, cfg, du)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SaveUser(u)
+		keys = append(keys, u.Keys()...)
+	}
+
+	if err := cfg.CheckRevoked(keys); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckKeyPolicy(keys); err != nil {
+		return nil, err
+	}
+
+	for _, g := range state.Groups {
+		for _, m := range g.Members {
+			if !cfg.UserExists(m) {
+				return nil, fmt.Errorf("member %q of group %q not exists", m, g.Name)
+			}
+		}
+		for _, n := range g.Groups {
+			if !lo.Contains(groups, n) {
+				return nil, fmt.Errorf("nested group %q of group %q not exists", n, g.Name)
+			}
+		}
+		cfg.SaveGroup(g)
+	}
+
+	for _, g := range cfg.Groups {
+		if _, err := cfg.GroupMembers(g.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	used := map[string]bool{}
+	for si, secret := range cfg.Secrets {
+		rule, ok, err := matchRule(state.Secrets, secret.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		used[rule.Pattern] = true
+		cfg.Secrets[si].Users = rule.Users
+		cfg.Secrets[si].Groups = rule.Groups
+	}
+
+	for _, rule := range state.Secrets {
+		if !used[rule.Pattern] {
+			log.Printf("pattern %q matches no secret", rule.Pattern)
+		}
+	}
+
+	for _, secret := range cfg.Secrets {
+		if _, err := cfg.GetRecipients(secret); err != nil {
+			return nil, fmt.Errorf("secret %q: %v", secret.Path, err)
+		}
+	}
+
+	if err := cfg.CheckAccessPolicies(cfg.Secrets); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// desiredUser normalizes the recipients of the desired user, fetching them
+// from the key source if there's none. Metadata of existing keys is kept
+// unless the desired state sets it.
+func desiredUser(ctx *Context, cfg *Config, du User) (User, error) {
+	recs := du.Recipients
+	if len(recs) == 0 && du.Source != nil {
+		if err := du.Source.Validate(); err != nil {
+			return User{}, fmt.Errorf("user %q: %v", du.Name, err)
+		}
+		keys, err := ctx.fetchKeys(du.Name, *du.Source)
+		if err != nil {
+			return User{}, fmt.Errorf("user %q: %v", du.Name, err)
+		}
+		recs = newRecipients(keys)
+	}
+
+	if len(recs) == 0 {
+		return User{}, fmt.Errorf("user %q has no recipients", du.Name)
+	}
+
+	old, _ := cfg.GetUser(du.Name)
+	for i := range recs {
+		key, err := normalizeRecipient(strings.TrimSpace(recs[i].Key))
+		if err != nil {
+			return User{}, fmt.Errorf("user %q: %v", du.Name, err)
+		}
+		recs[i].Key = key
+
+		if j := old.recipientIndex(key); j != -1 && recs[i].Device == "" && recs[i].Added == "" && recs[i].Comment == "" {
+			recs[i] = old.Recipients[j]
+			recs[i].Key = key
+		}
+	}
+
+	return User{Name: du.Name, Recipients: recs, Source: du.Source}, nil
+}
+
+func runApply(opts *applyOpt) error {
+	ctx := opts.ctx
+
+	state, err := readAccessState(opts.File)
+	if err != nil {
+		return err
+	}
+
+	after, err := desiredConfig(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	diff := configDiff(ctx.Config, after)
+	affected := affectedSecrets(ctx.Config, after)
+
+	if len(diff) == 0 && len(affected) == 0 {
+		fmt.Println("no changes")
+		return nil
+	}
+
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+	printAffectedSecrets(affected)
+
+	if opts.DryRun {
+		return nil
+	}
+
+	if err := ctx.checkConfigTrust(); err != nil {
+		return err
+	}
+
+	// encrypt everything first, so nothing is written if any secret fails
+	var missing []string
+	encrypted := map[string][]byte{}
+	signatures := map[string][]byte{}
+	shares := map[string][]byte{}
+	for _, secret := range affected {
+		path := filepath.Join(ctx.RootDir, secret.Path)
+		if !fileExists(path) {
+			missing = append(missing, secret.Path)
+			continue
+		}
+
+		recipients, err := after.GetRecipients(secret)
+		if err != nil {
+			return err
+		}
+
+		encrypted[path+".age"], shares[path+".age"], err = encryptSecret(path, recipients)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %q: %v", secret.Path, err)
+		}
+
+		signatures[path+".age"], err = signSecret(after, secret, encrypted[path+".age"], shares[path+".age"], opts.IdentityFile, ctx.signatureRequired(after, secret))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("secrets to re-encrypt are not decrypted, decrypt them first: %s", strings.Join(missing, ", "))
+	}
+
+	for path, b := range encrypted {
+		if err := WriteFile(path, b); err != nil {
+			return err
+		}
+		if err := writeSignature(path, signatures[path]); err != nil {
+			return err
+		}
+		if err := writeShares(path, shares[path]); err != nil {
+			return err
+		}
+		fmt.Printf("encrypted %q\n", path)
+	}
+
+	ctx.Config = after
+	return ctx.WriteConfigFile()
+}
+
+func newApplyCmd(ctx *Context) *cobra.Command {
+	opts := &applyOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Apply the desired state of users, groups and owners of secrets",
+		Long: `Apply the desired state of users, groups and owners of secrets.
+
+Users and groups not in the file are removed. Owners of secrets are set by the
+first pattern matching the path of the secret, "**" matches any number of
+directories. Secrets whose recipients change are re-encrypted, so they must
+be decrypted in the working tree. Nothing is written if any of them fails.
+
+  users:
+    - name: aca
+      source:
+        github: aca
+    - name: john
+      recipients:
+        - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHcOxFPXarxSbKwGUj6bTlxVec6LoPJQKPnVd/p7Zljq
+  groups:
+    - name: devops
+      members: [aca, john]
+  secrets:
+    - pattern: prod/**
+      groups: [devops]`,
+		Example: `  # show the plan without applying it
+  agec apply -f access.yaml --dry-run
+
+  agec apply -f access.yaml`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			if opts.File == "" {
+				return errors.New("specify the desired state with -f")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApply(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.File, "file", "f", "", "File of the desired state, if set to -, it's read from standard input.")
+	f.BoolVarP(&opts.DryRun, "dry-run", "n", false, "Only show the plan")
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "SSH private key to sign the encrypted files")
+
+	return cmd
+}
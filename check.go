@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+type checkOpt struct {
+	ctx *Context
+}
+
+// checkProblem is an issue found by `agec check`.
+type checkProblem struct {
+	Path    string
+	Message string
+}
+
+func runCheck(opts *checkOpt) error {
+	ctx := opts.ctx
+
+	checks := []func(*Context) ([]checkProblem, error){
+		checkRevokedKeys,
+		checkKeyPolicy,
+		checkGroups,
+		checkAccessPolicy,
+		checkSignature,
+		checkFileSignatures,
+		checkRecoveryRecipients,
+	}
+
+	var problems []checkProblem
+	for _, check := range checks {
+		p, err := check(ctx)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", p.Path, p.Message)
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+	return nil
+}
+
+// checkRevokedKeys finds revoked keys still held by users, and secrets which
+// are encrypted to revoked keys, including their shares and inner layers.
+func checkRevokedKeys(ctx *Context) ([]checkProblem, error) {
+	cfg := ctx.Config
+	var problems []checkProblem
+
+	for _, u := range cfg.Users {
+		for _, key := range u.Keys() {
+			if cfg.IsRevoked(key) {
+				problems = append(problems, checkProblem{
+					Path:    defaultConfigFilename,
+					Message: fmt.Sprintf("user %q has revoked key %q", u.Name, key),
+				})
+			}
+		}
+	}
+
+	// inner layers are only found with local identities
+	identities := localIdentities(os.Getenv("AGEC_IDENTITY"))
+
+	for _, secret := range cfg.Secrets {
+		encryptedFile := secret.Path + ".age"
+		ciphertext, err := os.ReadFile(filepath.Join(ctx.RootDir, encryptedFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		shares, err := os.ReadFile(filepath.Join(ctx.RootDir, encryptedFile+sharesExt))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		headers, err := fileHeaders(encryptedFile, ciphertext, shares, identities)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", encryptedFile, err)
+		}
+
+		// X25519 recipients are anonymous, fall back to the owners
+		owners, _ := cfg.RecipientKeys(secret.Users, secret.Groups)
+		owners = lo.Filter(owners, func(key string, _ int) bool {
+			return cfg.IsRevoked(key)
+		})
+
+		for _, fingerprint := range cfg.RevokedKeys {
+			tag, err := fingerprintTag(fingerprint)
+			if err != nil {
+				return nil, err
+			}
+
+			if (tag != "" && headersHaveTag(headers, tag)) || (tag == "" && lo.Contains(owners, fingerprint)) {
+				problems = append(problems, checkProblem{
+					Path:    encryptedFile,
+					Message: fmt.Sprintf("encrypted to revoked key %q", fingerprint),
+				})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// checkGroups finds cycles of nested groups.
+func checkGroups(ctx *Context) ([]checkProblem, error) {
+	var problems []checkProblem
+
+	for _, g := range ctx.Config.Groups {
+		if _, err := ctx.Config.GroupMembers(g.Name); err != nil {
+			problems = append(problems, checkProblem{
+				Path:    defaultConfigFilename,
+				Message: fmt.Sprintf("group %q: %v", g.Name, err),
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+func newCheckCmd(ctx *Context) *cobra.Command {
+	opts := &checkOpt{
+		ctx: ctx,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check config and encrypted files for problems",
+		Long: `Check config and encrypted files for problems, exits with non-zero status
+if any problem was found.
+
+  - revoked keys which are still used by users or encrypted files
+  - keys of users which violate the key policy
+  - cycles of nested groups
+  - owners of secrets which violate the access policy
+  - a config which is not signed by a trusted admin
+  - encrypted files which are not signed by their allowed writers
+  - encrypted files which the recovery recipients can't decrypt`,
+		Example: `  # run in CI
+  agec check`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCheck(opts)
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+
+	return cmd
+}
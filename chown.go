@@ -1,17 +1,28 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
 
 type chownOpt struct {
-	Users  []string
-	Groups []string
-	Files  []string
+	Users        []string
+	Groups       []string
+	Files        []string
+	ApplyRules   bool
+	Any          bool
+	All          bool
+	Threshold    int
+	IdentityFile string
+	AllowLockout bool
 
 	ctx *Context
 }
@@ -33,6 +44,11 @@ func runChown(opts *chownOpt) error {
 		}
 	}
 
+	var identities []age.Identity
+	if !opts.AllowLockout {
+		identities = localIdentities(opts.IdentityFile)
+	}
+
 	for _, file := range opts.Files {
 		var relpath string
 		var err error
@@ -53,12 +69,54 @@ func runChown(opts *chownOpt) error {
 			return fmt.Errorf("%q is not tracked by agec", file)
 		}
 
-		if opts.Users != nil {
-			secret.Users = opts.Users
+		if opts.ApplyRules {
+			rule, ok, err := matchRule(ctx.Config.Rules, secret.Path)
+			if err != nil {
+				return err
+			}
+
+			if !ok || (cmp.Equal(secret.Users, rule.Users, cmpopts.EquateEmpty()) && cmp.Equal(secret.Groups, rule.Groups, cmpopts.EquateEmpty())) {
+				continue
+			}
+
+			secret.Users = rule.Users
+			secret.Groups = rule.Groups
+		} else {
+			if opts.Users != nil {
+				secret.Users = opts.Users
+			}
+
+			if opts.Groups != nil {
+				secret.Groups = opts.Groups
+			}
 		}
 
-		if opts.Groups != nil {
-			secret.Groups = opts.Groups
+		if opts.Any {
+			secret.Mode = secretModeAny
+			secret.Threshold = 0
+		} else if opts.All {
+			secret.Mode = secretModeAll
+			secret.Threshold = 0
+		} else if opts.Threshold != 0 {
+			secret.Mode = secretModeThreshold
+			secret.Threshold = opts.Threshold
+		}
+
+		if err := ctx.Config.CheckMode(secret); err != nil {
+			return err
+		}
+
+		if err := ctx.Config.CheckAccessPolicy(secret); err != nil {
+			return err
+		}
+
+		recipients, err := ctx.Config.GetRecipients(secret)
+		if err != nil {
+			return fmt.Errorf("%q: %v", file, err)
+		}
+
+		if err := checkLockout(identities, recipients, file); err != nil {
+			return err
 		}
 
 		ctx.Config.SaveSecret(secret)
@@ -67,9 +125,11 @@ func runChown(opts *chownOpt) error {
 		ctx.Config.SaveSecret(secret)
 
 		// Remove encrypted file as it's owner has changed
-		err = os.Remove(file + ".age")
-		if err != nil && !os.IsNotExist(err) {
-			return err
+		for _, ext := range []string{".age", ".age" + signatureExt, ".age" + sharesExt} {
+			err = os.Remove(file + ext)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
 	}
 
@@ -85,10 +145,21 @@ func newChownCmd(ctx *Context) *cobra.Command {
 		Use:   "chown",
 		Short: "change owner user, group of secrets",
 		Example: `  # secret.txt will be encrypted using john's public keys
-  agec chown -g devops secret.txt`,
+  agec chown -g devops secret.txt
+
+  # set owners of all secrets under the current directory by rules in .agec.yaml
+  agec chown --apply-rules
+
+  # require two members of "sre" to decrypt secret.txt
+  agec chown -g sre --threshold 2 secret.txt`,
 		SilenceUsage:  true,
 		SilenceErrors: true,
-		Args:          cobra.MinimumNArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if opts.ApplyRules {
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			return nil, cobra.ShellCompDirectiveDefault
 		},
@@ -97,11 +168,29 @@ func newChownCmd(ctx *Context) *cobra.Command {
 				return ErrConfigurationNotFound
 			}
 
-			if opts.Users == nil {
+			if lo.Count([]bool{opts.Any, opts.All, opts.Threshold != 0}, true) > 1 {
+				return errors.New("only one of --any, --all, --threshold can be used")
+			}
+
+			if opts.ApplyRules {
+				if opts.Users != nil || opts.Groups != nil {
+					return errors.New("--apply-rules can't be used with --user, --group")
+				}
+
+				if len(args) == 0 {
+					opts.Files = secretsUnderWorkingDir(ctx)
+					return nil
+				}
+			}
+
+			// only changing the mode keeps the owners
+			modeOnly := opts.Users == nil && opts.Groups == nil && (opts.Any || opts.All || opts.Threshold != 0)
+
+			if opts.Users == nil && !modeOnly {
 				opts.Users = ctx.DefaultUsers
 			}
 
-			if opts.Groups == nil {
+			if opts.Groups == nil && !modeOnly {
 				opts.Groups = ctx.DefaultGroups
 			}
 
@@ -120,6 +209,12 @@ func newChownCmd(ctx *Context) *cobra.Command {
 	f := cmd.Flags()
 	f.StringSliceVarP(&opts.Users, "user", "u", nil, "List of users")
 	f.StringSliceVarP(&opts.Groups, "group", "g", nil, "List of groups")
+	f.BoolVar(&opts.ApplyRules, "apply-rules", false, "Set owners by the first matching rule in .agec.yaml")
+	f.BoolVar(&opts.Any, "any", false, "Let any of the owners decrypt secrets")
+	f.BoolVar(&opts.All, "all", false, "Require a key of every group and user to decrypt secrets")
+	f.IntVar(&opts.Threshold, "threshold", 0, "Require this many readers to decrypt secrets")
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Identity file to check you can still decrypt secrets")
+	f.BoolVar(&opts.AllowLockout, "allow-lockout", false, "Change owners even if none of your identities can decrypt the secrets")
 
 	cmd.RegisterFlagCompletionFunc("user", UserCompletion(ctx))
 	cmd.RegisterFlagCompletionFunc("group", GroupCompletion(ctx))
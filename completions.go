@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
 
@@ -28,6 +29,43 @@ func GroupCompletion(ctx *Context) func(cmd *cobra.Command, args []string, toCom
 	}
 }
 
+// NestedGroupCompletion completes groups which can be nested in the group of
+// the first argument without creating a cycle.
+func NestedGroupCompletion(ctx *Context) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return GroupCompletion(ctx)(cmd, args, toComplete)
+		}
+
+		groups := []string{}
+		for _, group := range ctx.Config.Groups {
+			if !lo.Contains(ctx.Config.NestedGroups(group.Name), args[0]) {
+				groups = append(groups, group.Name)
+			}
+		}
+		return groups, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// DeviceCompletion completes user names, then devices of the user.
+func DeviceCompletion(ctx *Context) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return UserCompletion(ctx)(cmd, args, toComplete)
+		}
+
+		devices := []string{}
+		if u, err := ctx.Config.GetUser(args[0]); err == nil {
+			for _, rec := range u.Recipients {
+				if rec.Device != "" {
+					devices = append(devices, rec.Device)
+				}
+			}
+		}
+		return devices, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
 func SecretCompletion(ctx *Context) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		var completions []string
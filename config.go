@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"filippo.io/age"
 	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
 )
 
 const defaultConfigFilename = ".agec.yaml"
@@ -15,22 +18,200 @@ type Config struct {
 	Users   []User   `json:"users"`
 	Groups  []Group  `json:"groups"`
 	Secrets []Secret `json:"secret"`
+
+	// RevokedKeys are fingerprints of compromised keys, which can't be used
+	// as recipients anymore.
+	RevokedKeys []string `yaml:"revoked_keys,omitempty"`
+
+	Policy Policy `yaml:"policy,omitempty"`
+
+	// Rules are default owners of new secrets.
+	Rules []OwnershipRule `yaml:"rules,omitempty"`
+
+	// Writers are users allowed to sign encrypted files, by path.
+	Writers []OwnershipRule `yaml:"writers,omitempty"`
+
+	// Filter stores secrets encrypted in place by the agec git filter, instead
+	// of in .age files next to links to their plaintext.
+	Filter bool `yaml:"filter,omitempty"`
+
+	// RecoveryRecipients are keys every secret is encrypted to, unless it's
+	// excluded.
+	RecoveryRecipients []RecoveryRecipient `yaml:"recovery_recipients,omitempty"`
+
+	// Admins are users whose SSH keys can sign the config.
+	Admins []string `yaml:"admins,omitempty"`
+
+	// Signature is an SSH signature by an admin over the part of the config
+	// which decides who can decrypt secrets, made by `agec config sign`.
+	Signature string `yaml:"signature,omitempty"`
 }
 
 type Group struct {
 	Name    string   `json:"name"`
 	Members []string `json:"members"`
+
+	// Groups are nested groups, whose members are also members of the group.
+	Groups []string `yaml:"groups,omitempty"`
 }
 
 type User struct {
-	Name       string   `json:"name"`
-	Recipients []string `json:"recipients"`
+	Name       string      `json:"name"`
+	Recipients []Recipient `json:"recipients"`
+
+	// Source is where the recipients are synced from by `agec key sync`.
+	Source *KeySource `yaml:"source,omitempty"`
+}
+
+// Recipient is a public key of a user, optionally with the device it belongs
+// to. Recipients without metadata are written as a plain public key.
+type Recipient struct {
+	Key     string `yaml:"key"`
+	Device  string `yaml:"device,omitempty"`
+	Added   string `yaml:"added,omitempty"`
+	Comment string `yaml:"comment,omitempty"`
+}
+
+func (r *Recipient) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		r.Key = value.Value
+		return nil
+	}
+
+	type plain Recipient
+	return value.Decode((*plain)(r))
+}
+
+func (r Recipient) MarshalYAML() (interface{}, error) {
+	if r.Device == "" && r.Added == "" && r.Comment == "" {
+		return r.Key, nil
+	}
+
+	type plain Recipient
+	return plain(r), nil
+}
+
+// newRecipients wraps public keys into recipients without metadata.
+func newRecipients(keys []string) []Recipient {
+	return lo.Map(keys, func(key string, _ int) Recipient {
+		return Recipient{Key: key}
+	})
+}
+
+// Keys returns the public keys of the user.
+func (u User) Keys() []string {
+	return lo.Map(u.Recipients, func(r Recipient, _ int) string {
+		return r.Key
+	})
+}
+
+// recipientIndex returns the index of the recipient with the same fingerprint
+// as key, which may also be a fingerprint, or -1.
+func (u User) recipientIndex(key string) int {
+	fingerprint, err := keyFingerprint(key)
+	if err != nil {
+		fingerprint = key
+	}
+
+	for i, rec := range u.Recipients {
+		if f, err := keyFingerprint(rec.Key); err == nil && f == fingerprint {
+			return i
+		}
+	}
+	return -1
+}
+
+// deviceIndex returns the index of the recipient of the device, or -1.
+func (u User) deviceIndex(device string) int {
+	if device == "" {
+		return -1
+	}
+
+	for i, rec := range u.Recipients {
+		if rec.Device == device {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceRecipients returns recipients for keys, keeping the metadata of the
+// keys which the user already has.
+func (u User) replaceRecipients(keys []string) []Recipient {
+	recs := newRecipients(keys)
+	for i := range recs {
+		if j := u.recipientIndex(recs[i].Key); j != -1 {
+			recs[i].Device = u.Recipients[j].Device
+			recs[i].Added = u.Recipients[j].Added
+			recs[i].Comment = u.Recipients[j].Comment
+		}
+	}
+	return recs
+}
+
+// OwnershipRule sets the owners of secrets whose path matches Pattern, "**"
+// matches any number of directories.
+type OwnershipRule struct {
+	Pattern string   `yaml:"pattern"`
+	Users   []string `yaml:"users,omitempty"`
+	Groups  []string `yaml:"groups,omitempty"`
+}
+
+// matchRule returns the first rule whose pattern matches the path.
+func matchRule(rules []OwnershipRule, path string) (OwnershipRule, bool, error) {
+	for _, rule := range rules {
+		ok, err := matchPattern(rule.Pattern, filepath.ToSlash(path))
+		if err != nil {
+			return OwnershipRule{}, false, fmt.Errorf("malformed pattern %q: %v", rule.Pattern, err)
+		}
+		if ok {
+			return rule, true, nil
+		}
+	}
+	return OwnershipRule{}, false, nil
 }
 
 type Secret struct {
 	Path   string   `json:"path"`
 	Groups []string `yaml:"groups"`
 	Users  []string `json:"users"`
+
+	// Mode is how the owners can decrypt the secret, any of them by default.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Threshold is the number of readers needed to decrypt a secret of the
+	// threshold mode.
+	Threshold int `yaml:"threshold,omitempty"`
+}
+
+const (
+	// secretModeAny secrets can be decrypted by any of the owners.
+	secretModeAny = ""
+
+	// secretModeAll secrets are encrypted in nested layers, one for each
+	// group and user, so decrypting needs a key of all of them.
+	secretModeAll = "all"
+
+	// secretModeThreshold secrets have their key split in shares for each
+	// reader, so decrypting needs shares of Threshold readers.
+	secretModeThreshold = "threshold"
+)
+
+// SecretRecipients are the recipients of a secret, arranged by its mode.
+type SecretRecipients struct {
+	// Layers are the recipients of each nested encryption, outermost first.
+	// Secrets of the any mode have a single layer.
+	Layers [][]age.Recipient
+
+	// Holders are the readers of a threshold secret, and Shares the
+	// recipients of their shares.
+	Holders   []string
+	Shares    [][]age.Recipient
+	Threshold int
+
+	// Recovery are the recovery recipients of a threshold secret, to which
+	// its whole key is encrypted.
+	Recovery []age.Recipient
 }
 
 func (cfg *Config) AddUser(name string, recipients []string) error {
@@ -40,20 +221,69 @@ func (cfg *Config) AddUser(name string, recipients []string) error {
 
 	cfg.Users = append(cfg.Users, User{
 		Name:       name,
-		Recipients: recipients,
+		Recipients: newRecipients(recipients),
 	})
 
 	return nil
 }
 
-func (cfg *Config) AddGroup(name string, members []string) error {
+// AddRecipient adds a public key to the user.
+func (cfg *Config) AddRecipient(name string, rec Recipient) error {
+	u, err := cfg.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	if u.recipientIndex(rec.Key) != -1 {
+		return fmt.Errorf("user %q already has key %q", name, rec.Key)
+	}
+
+	if rec.Device != "" && u.deviceIndex(rec.Device) != -1 {
+		return fmt.Errorf("user %q already has device %q", name, rec.Device)
+	}
+
+	u.Recipients = append(u.Recipients, rec)
+	cfg.SaveUser(u)
+	return nil
+}
+
+// RemoveRecipient removes a public key from the user. The key is given by its
+// device name, fingerprint or the public key itself.
+func (cfg *Config) RemoveRecipient(name string, key string) (Recipient, error) {
+	u, err := cfg.GetUser(name)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	i := u.deviceIndex(key)
+	if i == -1 {
+		i = u.recipientIndex(key)
+	}
+	if i == -1 {
+		return Recipient{}, fmt.Errorf("user %q has no device or key %q", name, key)
+	}
+
+	rec := u.Recipients[i]
+	u.Recipients = append(u.Recipients[:i:i], u.Recipients[i+1:]...)
+	cfg.SaveUser(u)
+	return rec, nil
+}
+
+func (cfg *Config) AddGroup(name string, members []string, groups []string) error {
 	if cfg.GroupExists(name) {
 		return fmt.Errorf("group %q already exists", name)
 	}
 
+	for _, group := range groups {
+		if !cfg.GroupExists(group) {
+			return fmt.Errorf("group %q not exists", group)
+		}
+	}
+
 	cfg.Groups = append(cfg.Groups, Group{
 		Members: members,
 		Name:    name,
+		Groups:  groups,
 	})
 
 	return nil
@@ -88,6 +318,13 @@ func (cfg *Config) RemoveGroup(name string) error {
 	}
 
 	cfg.Groups = groups
+
+	for gi := range cfg.Groups {
+		cfg.Groups[gi].Groups = lo.Filter(cfg.Groups[gi].Groups, func(v string, _ int) bool {
+			return v != name
+		})
+	}
+
 	return nil
 }
 
@@ -140,6 +377,56 @@ func (cfg *Config) GetGroup(name string) (Group, error) {
 	return Group{}, fmt.Errorf("group %q not exists", name)
 }
 
+// GroupMembers returns the members of the group, including members of nested
+// groups.
+func (cfg *Config) GroupMembers(name string) ([]string, error) {
+	members, err := cfg.groupMembers(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Uniq(members), nil
+}
+
+func (cfg *Config) groupMembers(name string, path []string) ([]string, error) {
+	if lo.Contains(path, name) {
+		cycle := append(path[lo.IndexOf(path, name):], name)
+		return nil, fmt.Errorf("group cycle: %s", strings.Join(cycle, " -> "))
+	}
+	path = append(path, name)
+
+	g, err := cfg.GetGroup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	members := append([]string{}, g.Members...)
+	for _, nested := range g.Groups {
+		m, err := cfg.groupMembers(nested, path)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	return members, nil
+}
+
+// NestedGroups returns the group and all groups nested in it, ignoring cycles.
+func (cfg *Config) NestedGroups(name string) []string {
+	groups := []string{name}
+	for i := 0; i < len(groups); i++ {
+		g, err := cfg.GetGroup(groups[i])
+		if err != nil {
+			continue
+		}
+		for _, nested := range g.Groups {
+			if !lo.Contains(groups, nested) {
+				groups = append(groups, nested)
+			}
+		}
+	}
+	return groups
+}
+
 func (cfg *Config) GetUser(name string) (User, error) {
 	for _, user := range cfg.Users {
 		if user.Name == name {
@@ -207,16 +494,17 @@ func (cfg *Config) UserExists(name string) bool {
 	return true
 }
 
-func (cfg *Config) GetRecipients(users []string, groups []string) ([]age.Recipient, error) {
+// RecipientKeys returns the deduplicated public keys of the given users and
+// members of the given groups.
+func (cfg *Config) RecipientKeys(users []string, groups []string) ([]string, error) {
 	keys := []string{}
-	recs := []age.Recipient{}
 
 	for _, group := range groups {
-		g, err := cfg.GetGroup(group)
+		members, err := cfg.GroupMembers(group)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, g.Members...)
+		users = append(users, members...)
 	}
 
 	for _, user := range users {
@@ -224,22 +512,151 @@ func (cfg *Config) GetRecipients(users []string, groups []string) ([]age.Recipie
 		if err != nil {
 			return nil, err
 		}
-		keys = append(keys, u.Recipients...)
+		keys = append(keys, u.Keys()...)
+	}
+
+	return lo.Uniq(keys), nil
+}
+
+// RevokeKey adds the fingerprint of a key to revoked keys.
+func (cfg *Config) RevokeKey(fingerprint string) error {
+	if lo.Contains(cfg.RevokedKeys, fingerprint) {
+		return fmt.Errorf("key %q is already revoked", fingerprint)
 	}
 
-	keys = lo.Uniq(keys)
+	cfg.RevokedKeys = append(cfg.RevokedKeys, fingerprint)
+	return nil
+}
+
+// IsRevoked reports whether the public key has been revoked.
+func (cfg *Config) IsRevoked(key string) bool {
+	fingerprint, err := keyFingerprint(key)
+	if err != nil {
+		return false
+	}
+	return lo.Contains(cfg.RevokedKeys, fingerprint)
+}
 
+// CheckRevoked returns an error if any of keys has been revoked.
+func (cfg *Config) CheckRevoked(keys []string) error {
 	for _, key := range keys {
-		rec, err := parseRecipient(key)
+		if cfg.IsRevoked(key) {
+			return fmt.Errorf("recipient %q is revoked", key)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) GetRecipients(secret Secret) (*SecretRecipients, error) {
+	if err := cfg.CheckMode(secret); err != nil {
+		return nil, err
+	}
+
+	keys, err := cfg.RecipientKeys(secret.Users, secret.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery, err := cfg.RecoveryKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.CheckRevoked(keys); err != nil {
+		return nil, fmt.Errorf("%v, remove it from its user with `agec usermod` first", err)
+	}
+	if err := cfg.CheckRevoked(recovery); err != nil {
+		return nil, fmt.Errorf("%v, remove it from recovery_recipients of %s first", err, defaultConfigFilename)
+	}
+
+	if err := cfg.CheckKeyPolicy(append(keys, recovery...)); err != nil {
+		return nil, err
+	}
+
+	// recovery recipients alone don't make a secret readable by anyone
+	if len(keys) == 0 {
+		return nil, errors.New("no recipients found, specify valid users or groups")
+	}
+
+	var recoveryRecs []age.Recipient
+	if len(recovery) != 0 {
+		recoveryRecs, err = parseKeys(recovery)
+		if err != nil {
+			return nil, fmt.Errorf("recovery recipient: %v", err)
+		}
+	}
+
+	switch secret.Mode {
+	case secretModeAny:
+		recs, err := parseKeys(lo.Uniq(append(keys, recovery...)))
 		if err != nil {
 			return nil, err
 		}
-		recs = append(recs, rec)
+		return &SecretRecipients{Layers: [][]age.Recipient{recs}}, nil
+
+	case secretModeAll:
+		recipients := &SecretRecipients{}
+		for _, group := range secret.Groups {
+			recs, err := cfg.ownerRecipients(nil, []string{group})
+			if err != nil {
+				return nil, fmt.Errorf("group %q: %v", group, err)
+			}
+			recipients.Layers = append(recipients.Layers, recs)
+		}
+		for _, user := range secret.Users {
+			recs, err := cfg.ownerRecipients([]string{user}, nil)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %v", user, err)
+			}
+			recipients.Layers = append(recipients.Layers, recs)
+		}
+		// every layer is encrypted to the recovery recipients too
+		for i := range recipients.Layers {
+			recipients.Layers[i] = append(recipients.Layers[i], recoveryRecs...)
+		}
+		return recipients, nil
+
+	case secretModeThreshold:
+		readers, err := cfg.Readers(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients := &SecretRecipients{Threshold: secret.Threshold, Recovery: recoveryRecs}
+		for _, user := range readers {
+			recs, err := cfg.ownerRecipients([]string{user}, nil)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %v", user, err)
+			}
+			recipients.Holders = append(recipients.Holders, user)
+			recipients.Shares = append(recipients.Shares, recs)
+		}
+		return recipients, nil
 	}
+	return nil, fmt.Errorf("unknown mode %q of secret %q", secret.Mode, secret.Path)
+}
 
-	if len(recs) == 0 {
-		return nil, errors.New("no recipients found, specify valid users or groups")
+// ownerRecipients returns the recipients of users and members of groups.
+func (cfg *Config) ownerRecipients(users []string, groups []string) ([]age.Recipient, error) {
+	keys, err := cfg.RecipientKeys(users, groups)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(keys)
+}
+
+func parseKeys(keys []string) ([]age.Recipient, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no recipients found")
 	}
 
+	recs := []age.Recipient{}
+	for _, key := range keys {
+		rec, err := parseRecipient(key)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
 	return recs, nil
 }
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newConfigCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "config",
+		Short:         "Manage the root config",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newConfigSignCmd(ctx),
+		newConfigVerifyCmd(ctx),
+	)
+
+	return cmd
+}
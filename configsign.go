@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+type configSignOpt struct {
+	IdentityFile string
+	Admins       []string
+
+	ctx *Context
+}
+
+func runConfigSign(opts *configSignOpt) error {
+	ctx := opts.ctx
+	cfg := ctx.Config
+
+	if len(opts.Admins) != 0 {
+		for _, name := range opts.Admins {
+			if !cfg.UserExists(name) {
+				return fmt.Errorf("user %q not exists", name)
+			}
+		}
+		cfg.Admins = opts.Admins
+	}
+
+	if len(cfg.Admins) == 0 {
+		return errors.New("no admins in config, specify them with --admin")
+	}
+
+	signers, err := loadSigners(opts.IdentityFile)
+	if err != nil {
+		return err
+	}
+
+	// the signature must be made by an admin trusted before this change, so
+	// admins can't be added by someone who isn't one
+	trusted, err := ctx.trustedAdmins()
+	if err != nil {
+		return err
+	}
+	if trusted == nil {
+		trusted = cfg.AdminKeys()
+	}
+
+	signer, ok := lo.Find(signers, func(s ssh.Signer) bool {
+		return hasKey(trusted, s.PublicKey())
+	})
+	if !ok {
+		return errors.New("none of your ssh keys is a trusted admin key")
+	}
+
+	sig, err := sshSign(signer, configSigNamespace, cfg.signedPayload())
+	if err != nil {
+		return err
+	}
+	cfg.Signature = string(sig)
+
+	err = ctx.WriteConfigFile()
+	if err != nil {
+		return err
+	}
+
+	ctx.ConfigTrustErr = ctx.verifyConfig()
+	if err := ctx.pinConfigAdmins(); err != nil {
+		return err
+	}
+
+	fmt.Printf("signed %s with %s\n", defaultConfigFilename, ssh.FingerprintSHA256(signer.PublicKey()))
+	return nil
+}
+
+func newConfigSignCmd(ctx *Context) *cobra.Command {
+	opts := &configSignOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "sign",
+		Short: "Sign the root config as an admin",
+		Long: `Sign users, groups, admins, revoked keys, policy, and the owners and modes
+of secrets and rules of the root config with an SSH key of an admin, so that
+only admins can change who can decrypt secrets. Adding a secret or changing
+its owners needs to be signed again, so once someone who is not an admin
+encrypts a new secret, encrypting refuses to use recipients until an admin
+reviews the config and signs it.
+
+Admin keys are trusted on first use, and pinned in .git/agec/admins by this
+command and by "agec config verify". Encrypting refuses to use recipients of a
+config which is not signed by a pinned admin key, unless AGEC_ALLOW_UNSIGNED
+is set. Signing a config with different admins moves the pin, so changing
+admins needs a signature by a current admin.
+
+The SSH key is read from the identity file, or from ssh-agent and unencrypted
+keys in ~/.ssh.`,
+		Example: `  # make aca an admin, and sign the config with aca's key
+  agec config sign --admin aca -i ~/.ssh/id_ed25519
+
+  # sign again after changing users
+  agec useradd john --github john
+  agec config sign`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConfigSign(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "SSH private key to sign with")
+	f.StringSliceVarP(&opts.Admins, "admin", "a", []string{}, "Set admins of the config")
+	cmd.RegisterFlagCompletionFunc("admin", UserCompletion(ctx))
+
+	return cmd
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+type configVerifyOpt struct {
+	ctx *Context
+}
+
+func runConfigVerify(opts *configVerifyOpt) error {
+	ctx := opts.ctx
+	cfg := ctx.Config
+
+	if err := ctx.pinConfigAdmins(); err != nil {
+		return err
+	}
+
+	pub, err := cfg.SignatureKey()
+	if err != nil {
+		fmt.Printf("%s has no admins, signing is not used\n", defaultConfigFilename)
+		return nil
+	}
+
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	fmt.Printf("%s is signed by %s (%s)\n", defaultConfigFilename, strings.Join(cfg.KeyOwners(key), ","), ssh.FingerprintSHA256(pub))
+	return nil
+}
+
+func newConfigVerifyCmd(ctx *Context) *cobra.Command {
+	opts := &configVerifyOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the root config is signed by a trusted admin",
+		Long: `Verify the root config is signed by a trusted admin, and pin its admin keys
+in .git/agec/admins. Keys are trusted on first use, and a config signed by a
+pinned admin with other admins moves the pin. Run it after pulling a config
+whose admins have changed.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConfigVerify(opts)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigIndent is the indentation of configs written from scratch.
+const defaultConfigIndent = 4
+
+// orderedConfigLists are the lists of the config whose order matters, as
+// their first match wins. New entries of other lists are sorted.
+var orderedConfigLists = []string{"rules", "writers", "access"}
+
+// marshalConfig encodes cfg on top of original, the yaml it was loaded from,
+// so that comments, the order of keys and entries, and the indentation of
+// original are kept. Entries new to original are added after the existing
+// ones, sorted by their name, path or key, except in lists whose order
+// matters.
+func marshalConfig(cfg *Config, original []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(original, &doc); err != nil || doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return yaml.Marshal(cfg)
+	}
+
+	var updated yaml.Node
+	if err := updated.Encode(cfg); err != nil {
+		return nil, err
+	}
+	doc.Content[0] = patchNode(doc.Content[0], &updated, false)
+
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(configIndent(original))
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// patchNode updates old to the content of updated, keeping the comments and
+// style of old and of its children which still exist.
+func patchNode(old, updated *yaml.Node, ordered bool) *yaml.Node {
+	if old.Kind != updated.Kind {
+		updated.HeadComment = old.HeadComment
+		updated.LineComment = old.LineComment
+		updated.FootComment = old.FootComment
+		return updated
+	}
+
+	switch updated.Kind {
+	case yaml.ScalarNode:
+		if old.Value != updated.Value || old.ShortTag() != updated.ShortTag() {
+			old.Value = updated.Value
+			old.Tag = updated.Tag
+			old.Style = updated.Style
+		}
+
+	case yaml.MappingNode:
+		var content []*yaml.Node
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			key := old.Content[i]
+			if value := mappingValue(updated, key.Value); value != nil {
+				content = append(content, key, patchNode(old.Content[i+1], value, isOrderedList(key.Value)))
+			}
+		}
+		for i := 0; i+1 < len(updated.Content); i += 2 {
+			if mappingValue(old, updated.Content[i].Value) == nil {
+				content = append(content, updated.Content[i], updated.Content[i+1])
+			}
+		}
+		old.Content = content
+
+	case yaml.SequenceNode:
+		used := make([]bool, len(old.Content))
+		var content, added []*yaml.Node
+		for _, n := range updated.Content {
+			id := nodeIdentity(n)
+			matched := false
+			for i, o := range old.Content {
+				if !used[i] && id != "" && nodeIdentity(o) == id {
+					used[i] = true
+					content = append(content, patchNode(o, n, false))
+					matched = true
+					break
+				}
+			}
+			if matched {
+				continue
+			}
+			if ordered {
+				content = append(content, n)
+			} else {
+				added = append(added, n)
+			}
+		}
+
+		sort.SliceStable(added, func(i, j int) bool {
+			return nodeIdentity(added[i]) < nodeIdentity(added[j])
+		})
+
+		// empty lists are written as [], which shouldn't stay in flow style
+		if len(old.Content) == 0 {
+			old.Style = updated.Style
+		}
+		old.Content = append(content, added...)
+
+	default:
+		return updated
+	}
+	return old
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func isOrderedList(key string) bool {
+	for _, k := range orderedConfigLists {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeIdentity identifies entries of lists across versions, by their value
+// or the name, path, pattern or key of mappings. Recipients are identified by
+// their key, whether they're written as a plain key or with metadata.
+func nodeIdentity(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value
+	case yaml.MappingNode:
+		for _, key := range []string{"name", "path", "pattern", "key"} {
+			if v := mappingValue(n, key); v != nil && v.Kind == yaml.ScalarNode {
+				return v.Value
+			}
+		}
+	}
+	return ""
+}
+
+// configIndent returns the indentation of a config, the smallest indentation
+// of its lines.
+func configIndent(b []byte) int {
+	indent := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		n := len(line) - len(trimmed)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || n == 0 {
+			continue
+		}
+		if indent == 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent < 2 {
+		return defaultConfigIndent
+	}
+	return indent
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,8 +19,14 @@ type Context struct {
 	RootConfig      string
 	WorkingDir      string
 	SecretStorePath string
+	GitHubURL       string
+	GitLabURL       string
 
 	Config *Config
+
+	// ConfigTrustErr is why the config can't be trusted, if it is not
+	// signed by an admin.
+	ConfigTrustErr error
 }
 
 func initContext() (*Context, error) {
@@ -28,6 +35,8 @@ func initContext() (*Context, error) {
 	ctx := &Context{
 		DefaultUsers:  []string{},
 		DefaultGroups: []string{},
+		GitHubURL:     defaultGitHubURL,
+		GitLabURL:     defaultGitLabURL,
 	}
 
 	ctx.WorkingDir, err = os.Getwd()
@@ -56,20 +65,44 @@ func initContext() (*Context, error) {
 	if os.Getenv("AGEC_GROUPS") != "" {
 		ctx.DefaultGroups = strings.Split(os.Getenv("AGEC_GROUPS"), ",")
 	}
+	if os.Getenv("AGEC_GITHUB_URL") != "" {
+		ctx.GitHubURL = os.Getenv("AGEC_GITHUB_URL")
+	}
+	if os.Getenv("AGEC_GITLAB_URL") != "" {
+		ctx.GitLabURL = os.Getenv("AGEC_GITLAB_URL")
+	}
 
 	ctx.RootDir = filepath.Dir(rootConfig)
 	ctx.SecretStorePath = filepath.Join(ctx.RootDir, "/.git/agec/objects")
 	ctx.RootConfig = rootConfig
+	ctx.ConfigTrustErr = ctx.verifyConfig()
 	return ctx, nil
 }
 
+// WriteConfigFile writes the config on top of the config file, keeping its
+// comments and formatting.
 func (ctx *Context) WriteConfigFile() error {
-	b, err := yaml.Marshal(ctx.Config)
+	original, err := os.ReadFile(ctx.RootConfig)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	b, err := marshalConfig(ctx.Config, original)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(ctx.RootConfig, b, 0o600)
+	err = os.WriteFile(ctx.RootConfig, b, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if ctx.ConfigTrustErr == nil && len(ctx.Config.Admins) != 0 {
+		if _, err := ctx.Config.SignatureKey(); err != nil {
+			log.Printf("%s has changed, it needs to be signed again by an admin with `agec config sign`", defaultConfigFilename)
+		}
+	}
+	return nil
 }
 
 var ErrConfigurationNotFound = errors.New("failed to find root config, reached max depth")
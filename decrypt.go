@@ -20,6 +20,7 @@ type decryptOpt struct {
 	Identities   []age.Identity
 	FileArg      string
 	Force        bool
+	ShareFiles   []string
 	ctx          *Context
 }
 
@@ -62,13 +63,22 @@ func runDecrypt(opts *decryptOpt) error {
 	}
 	decryptedFilePath := filepath.Join(opts.ctx.SecretStorePath, relPath)
 
-	f, err := os.Open(file)
+	b, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	ager, err := age.Decrypt(f, opts.Identities...)
+	secret, err := opts.ctx.Config.GetSecret(relPath)
+	if err != nil {
+		secret = Secret{Path: relPath}
+	}
+
+	err = opts.ctx.checkSecretSignature(secret, file, b)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := decryptSecret(secret, file, b, opts.Identities, opts.ShareFiles)
 	if err != nil {
 		return fmt.Errorf("failed to decrypt %q: %v", file, err)
 	}
@@ -84,7 +94,7 @@ func runDecrypt(opts *decryptOpt) error {
 	}
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, ager)
+	_, err = dstFile.Write(plaintext)
 	if err != nil {
 		return fmt.Errorf("failed to copy %q: %v", file, err)
 	}
@@ -101,6 +111,17 @@ func runDecrypt(opts *decryptOpt) error {
 		return err
 	}
 
+	err = opts.ctx.recordDecrypted(secret, b, plaintext)
+	if err != nil {
+		return err
+	}
+
+	// decrypting again discards the conflicts of a merge
+	err = opts.ctx.setConflict(secret.Path, false)
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("decrypted %q\n", decryptedFileLinkPath)
 	return nil
 }
@@ -124,6 +145,9 @@ func newDecryptCmd(ctx *Context) *cobra.Command {
   # or set env AGEC_IDENTITY_FILE
   AGEC_IDENTITY_FILE=~/.ssh/id_rsa agec decrypt secret.txt
   
+  # decrypt a threshold secret with shares handed over by other readers
+  agec decrypt signing.key.age --share john.share --share merry.share
+
   # decrypt all in current directory
   fd --extension age | xargs agec decrypt`,
 		SilenceUsage:  true,
@@ -134,44 +158,13 @@ func newDecryptCmd(ctx *Context) *cobra.Command {
 				return ErrConfigurationNotFound
 			}
 
-			if opts.IdentityFile == "" {
-				homedir, err := os.UserHomeDir()
-				if err != nil {
-					return err
-				}
-
-				sshdir := filepath.Join(homedir, ".ssh")
-
-				keyfiles, err := ioutil.ReadDir(sshdir)
-				if err != nil {
-					return err
-				}
-
-				for _, keyfile := range keyfiles {
-					if keyfile.IsDir() {
-						continue
-					}
-					ident, err := parseIdentitiesFile(filepath.Join(sshdir, keyfile.Name()))
-					if err != nil {
-						// TODO: debug log
-						continue
-					}
-					opts.Identities = append(opts.Identities, ident...)
-				}
-
-				if len(opts.Identities) == 0 {
-					return errors.New("failed to load identities from ~/.ssh, specify identity file")
-				}
-
-			} else {
-				ident, err := parseIdentitiesFile(opts.IdentityFile)
-				if err != nil {
-					return err
-				}
-				opts.Identities = append(opts.Identities, ident...)
+			// shares handed over may be enough to decrypt threshold secrets
+			var err error
+			opts.Identities, err = loadIdentities(opts.IdentityFile)
+			if err != nil && (opts.IdentityFile != "" || len(opts.ShareFiles) == 0) {
+				return err
 			}
 
-			var err error
 			opts.FileArg, err = sanitizeDecryptArg(args[0], ctx.WorkingDir)
 			if err != nil {
 				return err
@@ -187,10 +180,50 @@ func newDecryptCmd(ctx *Context) *cobra.Command {
 	f := cmd.Flags()
 	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Specify identity file to decrypt file")
 	f.BoolVarP(&opts.Force, "force", "f", false, "Overwrite an existing encrypted file")
+	f.StringSliceVar(&opts.ShareFiles, "share", nil, "Shares of a threshold secret handed over by other readers")
 
 	return cmd
 }
 
+// loadIdentities reads identities from identityFile, or from the keys found in
+// ~/.ssh if identityFile is empty.
+func loadIdentities(identityFile string) ([]age.Identity, error) {
+	if identityFile != "" {
+		return parseIdentitiesFile(identityFile)
+	}
+
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	sshdir := filepath.Join(homedir, ".ssh")
+
+	keyfiles, err := ioutil.ReadDir(sshdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []age.Identity
+	for _, keyfile := range keyfiles {
+		if keyfile.IsDir() {
+			continue
+		}
+		ident, err := parseIdentitiesFile(filepath.Join(sshdir, keyfile.Name()))
+		if err != nil {
+			// TODO: debug log
+			continue
+		}
+		identities = append(identities, ident...)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("failed to load identities from ~/.ssh, specify identity file")
+	}
+
+	return identities, nil
+}
+
 // https://github.com/FiloSottile/age/blob/cff70cffe2f665ef67cf243daafb064f0feb61a9/cmd/age/parse.go#L126
 func parseIdentitiesFile(name string) ([]age.Identity, error) {
 	var f *os.File
@@ -210,6 +243,10 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 	peeked := string(p)
 
 	switch {
+	// An identity file encrypted to a passphrase, e.g. by `agec init --passphrase`.
+	case strings.HasPrefix(peeked, "age-encryption") || strings.HasPrefix(peeked, "-----BEGIN AGE"):
+		return parseEncryptedIdentities(name, b)
+
 	case strings.HasPrefix(peeked, "-----BEGIN"):
 		const privateKeySizeLimit = 1 << 14 // 16 KiB
 		contents, err := io.ReadAll(io.LimitReader(b, privateKeySizeLimit))
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/samber/lo"
+)
+
+// configDiff describes the changes of users, groups and owners of secrets
+// between two configs, one change per line.
+func configDiff(before, after *Config) []string {
+	var diff []string
+
+	for _, u := range after.Users {
+		old, err := before.GetUser(u.Name)
+		if err != nil {
+			diff = append(diff, fmt.Sprintf("+ user %q", u.Name))
+			continue
+		}
+
+		for _, rec := range u.Recipients {
+			if old.recipientIndex(rec.Key) == -1 {
+				diff = append(diff, fmt.Sprintf("~ user %q + %s", u.Name, rec.Key))
+			}
+		}
+		for _, rec := range old.Recipients {
+			if u.recipientIndex(rec.Key) == -1 {
+				diff = append(diff, fmt.Sprintf("~ user %q - %s", u.Name, rec.Key))
+			}
+		}
+	}
+
+	for _, u := range before.Users {
+		if !after.UserExists(u.Name) {
+			diff = append(diff, fmt.Sprintf("- user %q", u.Name))
+		}
+	}
+
+	for _, g := range after.Groups {
+		old, err := before.GetGroup(g.Name)
+		if err != nil {
+			diff = append(diff, fmt.Sprintf("+ group %q", g.Name))
+		}
+
+		for _, m := range g.Members {
+			if !lo.Contains(old.Members, m) {
+				diff = append(diff, fmt.Sprintf("+ member %q of group %q", m, g.Name))
+			}
+		}
+		for _, m := range old.Members {
+			if !lo.Contains(g.Members, m) {
+				diff = append(diff, fmt.Sprintf("- member %q of group %q", m, g.Name))
+			}
+		}
+
+		for _, n := range g.Groups {
+			if !lo.Contains(old.Groups, n) {
+				diff = append(diff, fmt.Sprintf("+ nested group %q of group %q", n, g.Name))
+			}
+		}
+		for _, n := range old.Groups {
+			if !lo.Contains(g.Groups, n) {
+				diff = append(diff, fmt.Sprintf("- nested group %q of group %q", n, g.Name))
+			}
+		}
+	}
+
+	for _, g := range before.Groups {
+		if !after.GroupExists(g.Name) {
+			diff = append(diff, fmt.Sprintf("- group %q", g.Name))
+		}
+	}
+
+	for _, s := range after.Secrets {
+		old, err := before.GetSecret(s.Path)
+		if err != nil {
+			diff = append(diff, fmt.Sprintf("+ secret %q %s", s.Path, formatOwners(s)))
+			continue
+		}
+
+		if !cmp.Equal(old.Users, s.Users, cmpopts.EquateEmpty()) || !cmp.Equal(old.Groups, s.Groups, cmpopts.EquateEmpty()) {
+			diff = append(diff, fmt.Sprintf("~ secret %q %s -> %s", s.Path, formatOwners(old), formatOwners(s)))
+		}
+	}
+
+	for _, s := range before.Secrets {
+		if _, err := after.GetSecret(s.Path); err != nil {
+			diff = append(diff, fmt.Sprintf("- secret %q", s.Path))
+		}
+	}
+
+	return diff
+}
+
+func formatOwners(s Secret) string {
+	return fmt.Sprintf("users=%s groups=%s", strings.Join(s.Users, ","), strings.Join(s.Groups, ","))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// encryptRecord is what an encrypted file was produced from. It's recorded
+// locally, so that encrypting an unchanged secret again can keep its
+// ciphertext instead of producing a new random one.
+type encryptRecord struct {
+	// Plaintext is a digest of the plaintext keyed by a local key, so the
+	// record doesn't help guessing the plaintext.
+	Plaintext string `yaml:"plaintext"`
+
+	// Recipients is a fingerprint of the recipients and the mode.
+	Recipients string `yaml:"recipients"`
+
+	// Ciphertext is a digest of the encrypted file and its shares.
+	Ciphertext string `yaml:"ciphertext"`
+}
+
+func (ctx *Context) digestsPath() string {
+	return filepath.Join(ctx.RootDir, ".git", "agec", "digests")
+}
+
+func (ctx *Context) digestKeyPath() string {
+	return filepath.Join(ctx.RootDir, ".git", "agec", "digest.key")
+}
+
+// digestKey returns the local key of plaintext digests, generating it on
+// first use.
+func (ctx *Context) digestKey() ([]byte, error) {
+	b, err := os.ReadFile(ctx.digestKeyPath())
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(b)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(ctx.digestKeyPath()), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ctx.digestKeyPath(), []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newEncryptRecord returns the record of encrypting plaintext of secret, to
+// be completed with the digest of the ciphertext.
+func (ctx *Context) newEncryptRecord(secret Secret, plaintext []byte) (encryptRecord, error) {
+	digest, err := ctx.plaintextDigest(plaintext)
+	if err != nil {
+		return encryptRecord{}, err
+	}
+
+	return encryptRecord{
+		Plaintext:  digest,
+		Recipients: ctx.Config.recipientsFingerprint(secret),
+	}, nil
+}
+
+func (ctx *Context) plaintextDigest(plaintext []byte) (string, error) {
+	key, err := ctx.digestKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(plaintext)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// recipientsFingerprint identifies the recipients of a secret and how it's
+// encrypted to them.
+func (cfg *Config) recipientsFingerprint(secret Secret) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d\n", secret.Mode, secret.Threshold)
+	if secret.Mode == secretModeAll {
+		// the order of owners is the order of layers
+		fmt.Fprintf(h, "%s\n%s\n", strings.Join(secret.Groups, ","), strings.Join(secret.Users, ","))
+	}
+	if secret.Mode == secretModeThreshold {
+		readers, _ := cfg.Readers(secret)
+		sort.Strings(readers)
+		fmt.Fprintf(h, "%s\n", strings.Join(readers, ","))
+	}
+	fmt.Fprintf(h, "%s\n", strings.Join(cfg.recipientSet(secret), "\n"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func ciphertextDigest(ciphertext, shares []byte) string {
+	h := sha256.New()
+	h.Write(ciphertext)
+	h.Write(shares)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (ctx *Context) readEncryptRecords() (map[string]encryptRecord, error) {
+	records := map[string]encryptRecord{}
+
+	b, err := os.ReadFile(ctx.digestsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", ctx.digestsPath(), err)
+	}
+	return records, nil
+}
+
+func (ctx *Context) saveEncryptRecord(path string, record encryptRecord) error {
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return err
+	}
+	records[filepath.ToSlash(path)] = record
+
+	b, err := yaml.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ctx.digestsPath()), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(ctx.digestsPath(), b, 0o600)
+}
+
+// unchangedCiphertext returns the current encrypted file and shares of the
+// secret if they were produced from the same plaintext and recipients as
+// record, or nil if it needs to be encrypted again.
+func (ctx *Context) unchangedCiphertext(path string, encryptedFile string, record encryptRecord) ([]byte, []byte, error) {
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	old, ok := records[filepath.ToSlash(path)]
+	if !ok || old.Plaintext != record.Plaintext || old.Recipients != record.Recipients {
+		return nil, nil, nil
+	}
+
+	ciphertext, err := os.ReadFile(encryptedFile)
+	if err != nil {
+		return nil, nil, nil
+	}
+	shares, err := os.ReadFile(encryptedFile + sharesExt)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	// the encrypted file may have been replaced, e.g. by a pull
+	if old.Ciphertext != ciphertextDigest(ciphertext, shares) {
+		return nil, nil, nil
+	}
+	return ciphertext, shares, nil
+}
+
+// hasEncryptRecord reports whether there's a record of the secret at path.
+func (ctx *Context) hasEncryptRecord(path string) (bool, error) {
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return false, err
+	}
+	_, ok := records[filepath.ToSlash(path)]
+	return ok, nil
+}
+
+// matchesRecord reports whether ciphertext was produced from the same
+// plaintext and recipients as record.
+func (ctx *Context) matchesRecord(path string, record encryptRecord, ciphertext []byte) (bool, error) {
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return false, err
+	}
+
+	old, ok := records[filepath.ToSlash(path)]
+	return ok && old.Plaintext == record.Plaintext && old.Recipients == record.Recipients && old.Ciphertext == ciphertextDigest(ciphertext, nil), nil
+}
+
+// recordDecrypted records a decrypted file as produced from its plaintext, so
+// that encrypting it again unchanged keeps the file. As X25519 recipients are
+// anonymous, it's only recorded if all of the current recipients are SSH keys
+// and the header has a stanza tagged with each of them, and no other.
+func (ctx *Context) recordDecrypted(secret Secret, ciphertext, plaintext []byte) error {
+	if secret.Mode != secretModeAny {
+		return nil
+	}
+
+	keys := ctx.Config.recipientSet(secret)
+	if !lo.EveryBy(keys, func(key string) bool { return strings.HasPrefix(key, "ssh-") }) || !headerMatches(keys, ciphertext) {
+		return nil
+	}
+
+	record, err := ctx.newEncryptRecord(secret, plaintext)
+	if err != nil {
+		return err
+	}
+	record.Ciphertext = ciphertextDigest(ciphertext, nil)
+	return ctx.saveEncryptRecord(secret.Path, record)
+}
+
+// headerMatches reports whether the header of ciphertext has a stanza for each
+// of keys and no other. X25519 recipients are anonymous, so only the number of
+// their stanzas can be compared.
+func headerMatches(keys []string, ciphertext []byte) bool {
+	stanzas, err := readStanzas(bytes.NewReader(ciphertext))
+	if err != nil || len(keys) == 0 || len(stanzas) != len(keys) {
+		return false
+	}
+	for _, key := range keys {
+		tag, err := sshKeyTag(key)
+		if err != nil || (tag != "" && !stanzasHaveTag(stanzas, tag)) {
+			return false
+		}
+	}
+	return true
+}
+
+// decryptsUnchanged decrypts ciphertext of the secret with identities, and
+// reports whether it could, and whether it decrypts to plaintext and its
+// header matches the current recipients of its outermost layer. It stands in
+// for a missing record of the ciphertext, like in a fresh clone. Threshold
+// secrets can't be told without their shares.
+func (ctx *Context) decryptsUnchanged(secret Secret, ciphertext, plaintext []byte, identities []age.Identity) (bool, bool) {
+	var keys []string
+	switch secret.Mode {
+	case secretModeAny:
+		keys = ctx.Config.recipientSet(secret)
+	case secretModeAll:
+		recovery, err := ctx.Config.RecoveryKeys(secret)
+		if err != nil {
+			return false, false
+		}
+		keys = lo.Uniq(append(outermostOwners(ctx.Config, secret), recovery...))
+	default:
+		return false, false
+	}
+
+	out, err := decryptSecret(secret, "", ciphertext, identities, nil)
+	if err != nil {
+		return false, false
+	}
+	return true, bytes.Equal(out, plaintext) && headerMatches(keys, ciphertext)
+}
+
+// staleCiphertext reports whether the decrypted plaintext or the recipients
+// of the secret changed since ciphertext was encrypted from it. Without a
+// record, it's told by decrypting the ciphertext, and if that fails it's not
+// stale. A record of other ciphertext means it was replaced, e.g. by a pull,
+// and it's not stale either.
+func (ctx *Context) staleCiphertext(secret Secret, ciphertext, shares []byte) (bool, error) {
+	plaintext, err := os.ReadFile(filepath.Join(ctx.SecretStorePath, secret.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return false, err
+	}
+
+	old, ok := records[filepath.ToSlash(secret.Path)]
+	if !ok {
+		decrypted, unchanged := ctx.decryptsUnchanged(secret, ciphertext, plaintext, localIdentities(os.Getenv("AGEC_IDENTITY")))
+		return decrypted && !unchanged, nil
+	}
+	if old.Ciphertext != ciphertextDigest(ciphertext, shares) {
+		return false, nil
+	}
+
+	record, err := ctx.newEncryptRecord(secret, plaintext)
+	if err != nil {
+		return false, err
+	}
+	return record.Plaintext != old.Plaintext || record.Recipients != old.Recipients, nil
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"filippo.io/age"
 	"github.com/google/go-cmp/cmp"
 	"github.com/spf13/cobra"
 )
@@ -24,10 +22,16 @@ type SecretFile struct {
 }
 
 type encryptOpt struct {
-	Users   []string
-	Groups  []string
-	FileArg SecretFile
-	Force   bool
+	Users          []string
+	Groups         []string
+	FileArg        SecretFile
+	Force          bool
+	IdentityFile   string
+	All            bool
+	Threshold      int
+	AllowLockout   bool
+	Always         bool
+	AllowDowngrade bool
 
 	ctx *Context
 }
@@ -43,20 +47,36 @@ func runEncrypt(opts *encryptOpt) (rerr error) {
 		return nil
 	}
 
-	var recs []age.Recipient
+	if err := ctx.checkConfigTrust(); err != nil {
+		return err
+	}
 
 	secret, err := ctx.Config.GetSecret(f.RelFromRoot)
 	if err != nil {
 		// new secret
+		if len(opts.Users) == 0 && len(opts.Groups) == 0 {
+			rule, ok, err := matchRule(ctx.Config.Rules, f.RelFromRoot)
+			if err != nil {
+				return err
+			}
+			if ok {
+				log.Printf("using owners of rule %q for %q", rule.Pattern, f.Input)
+				opts.Users = rule.Users
+				opts.Groups = rule.Groups
+			}
+		}
+
 		secret = Secret{
 			Users:  opts.Users,
 			Groups: opts.Groups,
 			Path:   f.RelFromRoot,
 		}
 
-		recs, err = ctx.Config.GetRecipients(opts.Users, opts.Groups)
-		if err != nil {
-			return err
+		if opts.All {
+			secret.Mode = secretModeAll
+		} else if opts.Threshold != 0 {
+			secret.Mode = secretModeThreshold
+			secret.Threshold = opts.Threshold
 		}
 	} else {
 		// existing secret
@@ -72,43 +92,112 @@ func runEncrypt(opts *encryptOpt) (rerr error) {
 			}
 		}
 
-		recs, err = ctx.Config.GetRecipients(secret.Users, secret.Groups)
-		if err != nil {
-			return err
+		if (opts.All && secret.Mode != secretModeAll) || (opts.Threshold != 0 && opts.Threshold != secret.Threshold) {
+			return fmt.Errorf("mode of secret has changed, `agec chown` first")
 		}
 	}
 
-	out := &bytes.Buffer{}
-	agew, err := age.Encrypt(out, recs...)
+	recipients, err := ctx.Config.GetRecipients(secret)
 	if err != nil {
 		return err
 	}
-	defer agew.Close()
 
-	plainFile, err := os.Open(f.ABS)
-	if err != nil {
+	if err := ctx.Config.CheckAccessPolicy(secret); err != nil {
 		return err
 	}
 
-	_, err = io.Copy(agew, plainFile)
+	identities := localIdentities(opts.IdentityFile)
+	if !opts.AllowLockout {
+		if err := checkLockout(identities, recipients, f.Input); err != nil {
+			return err
+		}
+	}
+
+	if !opts.AllowDowngrade {
+		if err := checkDowngrade(secret, encryptedFile, identities); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Config.Filter {
+		return trackFiltered(ctx, secret)
+	}
+
+	plaintext, err := os.ReadFile(f.ABS)
 	if err != nil {
 		return err
 	}
 
-	if agew.Close() != nil {
+	if err := ctx.checkResolved(secret.Path, plaintext); err != nil {
 		return err
 	}
 
-	if plainFile.Close() != nil {
+	record, err := ctx.newEncryptRecord(secret, plaintext)
+	if err != nil {
 		return err
 	}
 
-	err = WriteFile(encryptedFile, out.Bytes())
-	if err != nil {
+	// age output is randomized, keep the ciphertext if nothing changed
+	var out, shares []byte
+	if !opts.Always {
+		out, shares, err = ctx.unchangedCiphertext(secret.Path, encryptedFile, record)
+		if err != nil {
+			return err
+		}
+	}
+	unchanged := out != nil
+
+	if !unchanged {
+		out, shares, err = encryptSecret(f.ABS, recipients)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a valid signature of an unchanged file is kept, signing it again would
+	// change the file for nothing
+	keepSig := false
+	if unchanged && fileExists(encryptedFile+signatureExt) {
+		keepSig = verifySecret(ctx.Config, secret, encryptedFile, out) == nil
+	}
+
+	if !keepSig {
+		sig, err := signSecret(ctx.Config, secret, out, shares, opts.IdentityFile, ctx.signatureRequired(ctx.Config, secret))
+		if err != nil {
+			return err
+		}
+
+		if !unchanged {
+			err = WriteFile(encryptedFile, out)
+			if err != nil {
+				return err
+			}
+
+			err = writeShares(encryptedFile, shares)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = writeSignature(encryptedFile, sig)
+		if err != nil {
+			return err
+		}
+	}
+
+	record.Ciphertext = ciphertextDigest(out, shares)
+	if err := ctx.saveEncryptRecord(secret.Path, record); err != nil {
+		return err
+	}
+	if err := ctx.setConflict(secret.Path, false); err != nil {
 		return err
 	}
 
-	fmt.Printf("encrypted %q\n", encryptedFile)
+	if unchanged {
+		fmt.Printf("unchanged %q\n", encryptedFile)
+	} else {
+		fmt.Printf("encrypted %q\n", encryptedFile)
+	}
 
 	err = os.MkdirAll(filepath.Dir(f.DecryptedPath), 0o777)
 	if err != nil {
@@ -161,8 +250,19 @@ func newEncryptCmd(ctx *Context) *cobra.Command {
   # AGEC_USER, AGRC_GROUP.
   AGEC_GROUP=admin,devops agec encrypt secret.txt
 
-  # re-encrypt all secrets under current directory
-  agec ls | xargs agec encrypt --force`,
+  # re-encrypt all secrets under current directory, files of unchanged
+  # secrets are kept as they are unless --always is passed
+  agec ls | xargs agec encrypt --force
+
+  # two of the members of "sre" are needed to decrypt secret
+  agec encrypt -g sre --threshold 2 secret.txt
+
+  # only users who are both in "sre" and hold a key of "ci" can decrypt secret
+  agec encrypt -g sre,ci --all secret.txt
+
+  # sign the encrypted file with a specific key, by default keys in
+  # ssh-agent and '~/.ssh/*' of an allowed writer are used
+  agec encrypt secret.txt -i ~/.ssh/id_ed25519`,
 
 		SilenceUsage:  true,
 		SilenceErrors: true,
@@ -172,6 +272,10 @@ func newEncryptCmd(ctx *Context) *cobra.Command {
 				return ErrConfigurationNotFound
 			}
 
+			if opts.All && opts.Threshold != 0 {
+				return errors.New("--all can't be used with --threshold")
+			}
+
 			if opts.Users == nil {
 				opts.Users = ctx.DefaultUsers
 			}
@@ -196,6 +300,12 @@ func newEncryptCmd(ctx *Context) *cobra.Command {
 	f.StringSliceVarP(&opts.Users, "user", "u", nil, "List of users")
 	f.StringSliceVarP(&opts.Groups, "group", "g", nil, "List of groups")
 	f.BoolVarP(&opts.Force, "force", "f", false, "Overwrite an existing decrypted file")
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "SSH private key to sign the encrypted file")
+	f.BoolVar(&opts.All, "all", false, "Require a key of every group and user to decrypt a new secret")
+	f.IntVar(&opts.Threshold, "threshold", 0, "Require this many readers to decrypt a new secret")
+	f.BoolVar(&opts.AllowLockout, "allow-lockout", false, "Encrypt even if none of your identities can decrypt the secret")
+	f.BoolVar(&opts.Always, "always", false, "Encrypt again even if neither the plaintext nor the recipients changed")
+	f.BoolVar(&opts.AllowDowngrade, "allow-downgrade", false, "Encrypt even if the existing encrypted file needs more readers to decrypt")
 
 	cmd.RegisterFlagCompletionFunc("user", UserCompletion(ctx))
 	cmd.RegisterFlagCompletionFunc("group", GroupCompletion(ctx))
@@ -222,6 +332,9 @@ func sanitizeEncryptArg(ctx *Context, arg string, workingDir string) (SecretFile
 		if err != nil {
 			return tf, err
 		}
+		if !filepath.IsAbs(tf.RealPath) {
+			tf.RealPath = filepath.Join(filepath.Dir(tf.Input), tf.RealPath)
+		}
 	} else {
 		tf.RealPath = tf.Input
 	}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"filippo.io/age"
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+type exposureOpt struct {
+	Target       string
+	IdentityFile string
+	Identities   []age.Identity
+
+	ctx *Context
+}
+
+// exposedRevision is a revision of a secret that the target key could decrypt.
+type exposedRevision struct {
+	Path   string
+	Commit string
+	Blob   string
+	Status string
+}
+
+const (
+	exposureExposed = "exposed"
+	exposureRotated = "rotated"
+	exposureUnknown = "unknown"
+	exposureRemoved = "removed"
+)
+
+func runExposure(opts *exposureOpt) error {
+	ctx := opts.ctx
+
+	keys, err := exposureKeys(ctx, opts.Target)
+	if err != nil {
+		return err
+	}
+
+	commits, err := ctx.gitLines("log", "--reverse", "--format=%H", "--", defaultConfigFilename, "*.age")
+	if err != nil {
+		return err
+	}
+
+	var exposed []exposedRevision
+	seen := map[string]bool{}
+	for _, commit := range commits {
+		cfg, err := ctx.gitConfigAt(commit)
+		if err != nil {
+			cfg = &Config{}
+		}
+
+		files, err := ctx.gitEncryptedFiles(commit)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if seen[file.Path+"\x00"+file.Blob] {
+				continue
+			}
+			seen[file.Path+"\x00"+file.Blob] = true
+
+			ok, err := isRecipientAt(ctx, cfg, commit, file, keys, opts.Identities)
+			if err != nil {
+				return err
+			}
+			if ok {
+				exposed = append(exposed, exposedRevision{
+					Path:   file.Path,
+					Commit: commit,
+					Blob:   file.Blob,
+				})
+			}
+		}
+	}
+
+	if len(exposed) == 0 {
+		fmt.Printf("no secrets were ever encrypted to %q\n", opts.Target)
+		return nil
+	}
+
+	head, err := ctx.gitEncryptedFiles("HEAD")
+	if err != nil {
+		return err
+	}
+	headBlobs := map[string]string{}
+	for _, file := range head {
+		headBlobs[file.Path] = file.Blob
+	}
+
+	for i, rev := range exposed {
+		exposed[i].Status = exposureStatus(ctx, opts.Identities, rev, headBlobs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, rev := range exposed {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", rev.Path, rev.Commit[:7], rev.Status)
+	}
+	return w.Flush()
+}
+
+// exposureKeys resolves target to the public keys it ever had. Target is either
+// a public key or a user name, in which case every key the user had in any
+// revision of the root config is included.
+func exposureKeys(ctx *Context, target string) ([]string, error) {
+	if strings.HasPrefix(target, "age1") || strings.HasPrefix(target, "ssh-") {
+		if _, err := parseRecipient(target); err != nil {
+			return nil, err
+		}
+		return []string{target}, nil
+	}
+
+	keys := []string{}
+	if u, err := ctx.Config.GetUser(target); err == nil {
+		keys = append(keys, u.Keys()...)
+	}
+
+	commits, err := ctx.gitLines("log", "--format=%H", "--", defaultConfigFilename)
+	if err != nil {
+		return nil, err
+	}
+	for _, commit := range commits {
+		cfg, err := ctx.gitConfigAt(commit)
+		if err != nil {
+			continue
+		}
+		if u, err := cfg.GetUser(target); err == nil {
+			keys = append(keys, u.Keys()...)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("user %q not exists in any revision of %s", target, defaultConfigFilename)
+	}
+	return lo.Uniq(keys), nil
+}
+
+// isRecipientAt reports whether any of keys could decrypt file at commit, or
+// a share of it. SSH keys are matched against the key tags in the age headers
+// of the file, its shares and the inner layers identities can decrypt. X25519
+// recipients are anonymous, so they are matched against the owners and recovery
+// recipients of the secret in cfg.
+func isRecipientAt(ctx *Context, cfg *Config, commit string, file gitTreeEntry, keys []string, identities []age.Identity) (bool, error) {
+	b, err := ctx.git("cat-file", "blob", file.Blob)
+	if err != nil {
+		return false, err
+	}
+	shares, _ := ctx.git("cat-file", "blob", commit+":"+file.Path+sharesExt)
+
+	headers, err := fileHeaders(file.Path, b, shares, identities)
+	if err != nil {
+		return false, nil
+	}
+
+	var owners []string
+	if secret, err := cfg.GetSecret(strings.TrimSuffix(file.Path, ".age")); err == nil {
+		owners, _ = cfg.RecipientKeys(secret.Users, secret.Groups)
+		recovery, _ := cfg.RecoveryKeys(secret)
+		owners = append(owners, recovery...)
+	}
+
+	for _, key := range keys {
+		tag, err := sshKeyTag(key)
+		if err != nil {
+			return false, err
+		}
+
+		if tag != "" {
+			if headersHaveTag(headers, tag) {
+				return true, nil
+			}
+		} else if lo.Contains(owners, key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// exposureStatus reports whether the value of rev is still the current value
+// of the secret. When the ciphertext has changed since rev, both revisions are
+// decrypted with identities to compare the plaintext.
+func exposureStatus(ctx *Context, identities []age.Identity, rev exposedRevision, headBlobs map[string]string) string {
+	headBlob, ok := headBlobs[rev.Path]
+	if !ok {
+		return exposureRemoved
+	}
+
+	if headBlob == rev.Blob {
+		return exposureExposed
+	}
+
+	if len(identities) == 0 {
+		return exposureUnknown
+	}
+
+	old, err := decryptBlob(ctx, rev.Blob, identities)
+	if err != nil {
+		return exposureUnknown
+	}
+
+	cur, err := decryptBlob(ctx, headBlob, identities)
+	if err != nil {
+		return exposureUnknown
+	}
+
+	if bytes.Equal(old, cur) {
+		return exposureExposed
+	}
+	return exposureRotated
+}
+
+func decryptBlob(ctx *Context, blob string, identities []age.Identity) ([]byte, error) {
+	b, err := ctx.git("cat-file", "blob", blob)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(b), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func newExposureCmd(ctx *Context) *cobra.Command {
+	opts := &exposureOpt{
+		ctx: ctx,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "exposure",
+		Short: "List every revision of secrets a user or public key could decrypt",
+		Long: `List every revision of secrets in git history that a user or public key
+was a recipient of, and whether that value is still the current one.
+
+  exposed  the secret at HEAD still holds the value the key could decrypt
+  rotated  the secret has changed content since
+  unknown  the ciphertext has changed, but it could not be decrypted to compare
+  removed  the secret is no longer in HEAD
+
+SSH keys are matched using the key tags in age headers, including the ones of
+shares of threshold secrets, and of inner layers of secrets of the all mode
+which the identity can decrypt. X25519 keys are anonymous in age headers, so
+they are matched using the owners and recovery recipients of the secret in the
+root config of the same revision.`,
+		Example: `  # secrets the departed user "john" ever had access to
+  agec exposure john
+
+  # secrets a lost laptop's key ever had access to
+  agec exposure "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHcOxFPXarxSbKwGUj6bTlxVec6LoPJQKPnVd/p7Zljq"`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			opts.Target = args[0]
+
+			// identities are only needed to tell rotated secrets from
+			// re-encrypted ones and to find inner layers, so missing keys in
+			// ~/.ssh are not an error.
+			var err error
+			opts.Identities, err = loadIdentities(opts.IdentityFile)
+			if err != nil && opts.IdentityFile != "" {
+				return err
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runExposure(opts)
+		},
+		ValidArgsFunction: UserCompletion(ctx),
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Identity file used to compare the content of revisions and read inner layers")
+
+	return cmd
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+const filterDriver = "agec"
+
+func newFilterCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "filter",
+		Short: "Encrypt and decrypt secrets as a git filter",
+		Long: `Encrypt and decrypt secrets as the git filter set up by
+'agec git setup --filter'. The working tree holds the plaintext of secrets,
+and git stores them encrypted.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newFilterCleanCmd(ctx),
+		newFilterSmudgeCmd(ctx),
+		newFilterProcessCmd(ctx),
+	)
+
+	return cmd
+}
+
+// filterAttribute is the line of .gitattributes which applies the filter to
+// the secret at path.
+func filterAttribute(path string) string {
+	pattern := "/" + strings.ReplaceAll(filepath.ToSlash(path), " ", "[ ]")
+	return fmt.Sprintf("%s filter=%s diff=%s merge=%s", pattern, filterDriver, filterDriver, mergeDriver)
+}
+
+// filter encrypts and decrypts secrets for git. It's kept across files by the
+// long running filter process.
+type filter struct {
+	ctx *Context
+
+	prefix     string
+	identities []age.Identity
+	loaded     bool
+}
+
+func newFilter(ctx *Context) (*filter, error) {
+	prefix, err := ctx.gitPrefix()
+	if err != nil {
+		return nil, err
+	}
+	return &filter{ctx: ctx, prefix: prefix}, nil
+}
+
+func (f *filter) secret(path string) (Secret, error) {
+	return f.ctx.Config.GetSecret(fromGitPath(f.prefix, path))
+}
+
+// clean encrypts the plaintext of the secret at path. If neither the
+// plaintext nor the recipients changed, the ciphertext in the index is kept,
+// so that git doesn't see the secret as modified.
+func (f *filter) clean(path string, plaintext []byte) ([]byte, error) {
+	ctx := f.ctx
+
+	// checked out encrypted by someone who can't decrypt it
+	if _, err := readStanzas(bytes.NewReader(plaintext)); err == nil {
+		return plaintext, nil
+	}
+
+	secret, err := f.secret(path)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not tracked by agec, refusing to store its plaintext", path)
+	}
+	if secret.Mode == secretModeThreshold {
+		return nil, fmt.Errorf("%q is a threshold secret, which the filter can't store", path)
+	}
+
+	if err := ctx.checkResolved(secret.Path, plaintext); err != nil {
+		return nil, err
+	}
+
+	record, err := ctx.newEncryptRecord(secret, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if ciphertext, ok := ctx.gitIndexBlob(secret.Path); ok {
+		unchanged, err := ctx.matchesRecord(secret.Path, record, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		if unchanged {
+			return ciphertext, nil
+		}
+
+		// without a record, like of X25519 recipients in a fresh clone, the
+		// ciphertext is decrypted to tell
+		recorded, err := ctx.hasEncryptRecord(secret.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !recorded {
+			if _, unchanged := ctx.decryptsUnchanged(secret, ciphertext, plaintext, f.localIdentities()); unchanged {
+				record.Ciphertext = ciphertextDigest(ciphertext, nil)
+				return ciphertext, ctx.saveEncryptRecord(secret.Path, record)
+			}
+		}
+	}
+
+	if err := ctx.checkConfigTrust(); err != nil {
+		return nil, err
+	}
+
+	recipients, err := ctx.Config.GetRecipients(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Config.CheckAccessPolicy(secret); err != nil {
+		return nil, err
+	}
+
+	out, _, err := encryptPlaintext(plaintext, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Ciphertext = ciphertextDigest(out, nil)
+	if err := ctx.saveEncryptRecord(secret.Path, record); err != nil {
+		return nil, err
+	}
+	if err := ctx.setConflict(secret.Path, false); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// smudge decrypts the secret at path. Secrets which can't be decrypted are
+// checked out encrypted with a warning, so that checkouts keep working for
+// everyone.
+// localIdentities loads the identities once for all files of the process.
+func (f *filter) localIdentities() []age.Identity {
+	if !f.loaded {
+		f.identities, _ = loadIdentities(os.Getenv("AGEC_IDENTITY"))
+		f.loaded = true
+	}
+	return f.identities
+}
+
+func (f *filter) smudge(path string, ciphertext []byte) ([]byte, error) {
+	ctx := f.ctx
+
+	if _, err := readStanzas(bytes.NewReader(ciphertext)); err != nil {
+		return ciphertext, nil
+	}
+
+	secret, err := f.secret(path)
+	if err != nil {
+		secret = Secret{Path: fromGitPath(f.prefix, path)}
+	}
+
+	plaintext, err := decryptSecret(secret, "", ciphertext, f.localIdentities(), nil)
+	if err != nil {
+		log.Printf("WARNING: %q is checked out encrypted: %v", path, err)
+		return ciphertext, nil
+	}
+
+	if err := ctx.recordDecrypted(secret, ciphertext, plaintext); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// checkFilterWriters returns an error if the config has writers rules, as
+// the filter neither signs the files it encrypts nor verifies them.
+func checkFilterWriters(cfg *Config) error {
+	if len(cfg.Writers) != 0 {
+		return fmt.Errorf("writers of secrets are set in %s, which the filter can't sign, remove them to store secrets with the filter", defaultConfigFilename)
+	}
+	return nil
+}
+
+// trackFiltered tracks a secret stored with the filter, which encrypts it
+// when it's staged.
+func trackFiltered(ctx *Context, secret Secret) error {
+	if secret.Mode == secretModeThreshold {
+		return fmt.Errorf("%q is a threshold secret, which the filter can't store", secret.Path)
+	}
+	if err := checkFilterWriters(ctx.Config); err != nil {
+		return err
+	}
+
+	ctx.Config.SaveSecret(secret)
+	if err := addGitAttributes(ctx, []string{filterAttribute(secret.Path)}); err != nil {
+		return err
+	}
+	if err := ctx.WriteConfigFile(); err != nil {
+		return err
+	}
+
+	// staged secrets are only encrypted again if git sees them changed
+	add := "git add"
+	if _, ok := ctx.gitIndexBlob(secret.Path); ok {
+		add = "git add --renormalize"
+	}
+	fmt.Printf("%q is stored with the filter, stage it with `%s %s`\n", secret.Path, add, secret.Path)
+	return nil
+}
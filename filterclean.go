@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+type filterCleanOpt struct {
+	Path string
+
+	ctx *Context
+}
+
+func runFilterClean(opts *filterCleanOpt) error {
+	f, err := newFilter(opts.ctx)
+	if err != nil {
+		return err
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	out, err := f.clean(opts.Path, in)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func newFilterCleanCmd(ctx *Context) *cobra.Command {
+	opts := &filterCleanOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "clean <path>",
+		Short: "Encrypt a secret from stdin to stdout",
+		Long: `Encrypt the plaintext of the secret at <path> from stdin to stdout, as the
+clean command of the git filter. Unchanged secrets keep their ciphertext in
+the index.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.Path = args[0]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runFilterClean(opts)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// pktMaxData is the maximum length of the data of a pkt-line.
+const pktMaxData = 65516
+
+type filterProcessOpt struct {
+	ctx *Context
+}
+
+// runFilterProcess serves the long running filter process protocol of git,
+// see gitattributes(5), so that git starts agec once for all of the secrets.
+func runFilterProcess(opts *filterProcessOpt) error {
+	f, err := newFilter(opts.ctx)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+
+	hello, err := readPktLines(r)
+	if err != nil {
+		return err
+	}
+	if len(hello) < 2 || hello[0] != "git-filter-client" || !strings.HasPrefix(hello[1], "version=") {
+		return errors.New("unknown filter protocol")
+	}
+	if err := writePktLines(w, "git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// the capabilities of git don't matter, both are needed
+	if _, err := readPktLines(r); err != nil {
+		return err
+	}
+	if err := writePktLines(w, "capability=clean", "capability=smudge"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		header, err := readPktLines(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var command, pathname string
+		for _, line := range header {
+			key, value, _ := strings.Cut(line, "=")
+			switch key {
+			case "command":
+				command = value
+			case "pathname":
+				pathname = value
+			}
+		}
+
+		content, err := readPktContent(r)
+		if err != nil {
+			return err
+		}
+
+		var out []byte
+		switch command {
+		case "clean":
+			out, err = f.clean(pathname, content)
+		case "smudge":
+			out, err = f.smudge(pathname, content)
+		default:
+			err = fmt.Errorf("unknown filter command %q", command)
+		}
+
+		if err != nil {
+			log.Printf("%s %q: %v", command, pathname, err)
+			if err := writePktLines(w, "status=error"); err != nil {
+				return err
+			}
+		} else {
+			if err := writePktLines(w, "status=success"); err != nil {
+				return err
+			}
+			if err := writePktContent(w, out); err != nil {
+				return err
+			}
+			// an empty list keeps the status
+			if err := writePktLines(w); err != nil {
+				return err
+			}
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// readPkt reads a pkt-line, and reports whether it's a flush packet.
+func readPkt(r *bufio.Reader) ([]byte, bool, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, false, err
+	}
+
+	n, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed pkt-line length %q", header)
+	}
+	if n == 0 {
+		return nil, true, nil
+	}
+	if n < 4 {
+		return nil, false, fmt.Errorf("malformed pkt-line length %q", header)
+	}
+
+	data := make([]byte, n-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// readPktLines reads text pkt-lines up to a flush packet. It returns io.EOF
+// only if the input ended before the first packet.
+func readPktLines(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		data, flush, err := readPkt(r)
+		if errors.Is(err, io.EOF) && lines == nil {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		if flush {
+			return lines, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+func readPktContent(r *bufio.Reader) ([]byte, error) {
+	var content []byte
+	for {
+		data, flush, err := readPkt(r)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return content, nil
+		}
+		content = append(content, data...)
+	}
+}
+
+func writePkt(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writeFlushPkt(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+func writePktLines(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		if err := writePkt(w, []byte(line+"\n")); err != nil {
+			return err
+		}
+	}
+	return writeFlushPkt(w)
+}
+
+func writePktContent(w io.Writer, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > pktMaxData {
+			n = pktMaxData
+		}
+		if err := writePkt(w, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeFlushPkt(w)
+}
+
+func newFilterProcessCmd(ctx *Context) *cobra.Command {
+	opts := &filterProcessOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "process",
+		Short: "Serve the long running filter process of git",
+		Long: `Encrypt and decrypt secrets for git over the long running filter process
+protocol, as the process command of the git filter. git starts it once for
+all of the secrets, instead of running clean and smudge for each of them.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runFilterProcess(opts)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+type filterSmudgeOpt struct {
+	Path string
+
+	ctx *Context
+}
+
+func runFilterSmudge(opts *filterSmudgeOpt) error {
+	f, err := newFilter(opts.ctx)
+	if err != nil {
+		return err
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	out, err := f.smudge(opts.Path, in)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func newFilterSmudgeCmd(ctx *Context) *cobra.Command {
+	opts := &filterSmudgeOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "smudge <path>",
+		Short: "Decrypt a secret from stdin to stdout",
+		Long: `Decrypt the secret at <path> from stdin to stdout, as the smudge command of
+the git filter. Secrets none of your identities can decrypt are written
+encrypted.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.Path = args[0]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runFilterSmudge(opts)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshFingerprintPrefix = "SHA256:"
+
+// keyFingerprint returns the fingerprint of a public key. SSH keys use the
+// same SHA256 fingerprint as ssh-keygen -l, X25519 keys are their own
+// fingerprint.
+func keyFingerprint(key string) (string, error) {
+	switch {
+	case strings.HasPrefix(key, "age1"):
+		return key, nil
+	case strings.HasPrefix(key, "ssh-"):
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return "", err
+		}
+		return ssh.FingerprintSHA256(pk), nil
+	}
+	return "", fmt.Errorf("unknown recipient type: %q", key)
+}
+
+// fingerprintTag returns the key tag agessh stores in stanzas for the SSH key
+// with the given fingerprint, or an empty string for X25519 keys.
+func fingerprintTag(fingerprint string) (string, error) {
+	if !strings.HasPrefix(fingerprint, sshFingerprintPrefix) {
+		return "", nil
+	}
+
+	h, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, sshFingerprintPrefix))
+	if err != nil || len(h) < 4 {
+		return "", fmt.Errorf("malformed fingerprint %q", fingerprint)
+	}
+	return base64.RawStdEncoding.EncodeToString(h[:4]), nil
+}
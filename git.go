@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// git runs git in the root directory of agec and returns its stdout.
+func (ctx *Context) git(args ...string) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = ctx.RootDir
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitLines is like git, but splits the output into non-empty lines.
+func (ctx *Context) gitLines(args ...string) ([]string, error) {
+	out, err := ctx.git(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+type gitTreeEntry struct {
+	Blob string
+	Path string
+}
+
+// gitEncryptedFiles lists the .age files under the root directory at the
+// given revision, with paths relative to the root directory.
+func (ctx *Context) gitEncryptedFiles(rev string) ([]gitTreeEntry, error) {
+	lines, err := ctx.gitLines("ls-tree", "-r", rev, "--", ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []gitTreeEntry
+	for _, line := range lines {
+		// <mode> SP <type> SP <object> TAB <file>
+		meta, path, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" || !strings.HasSuffix(path, ".age") {
+			continue
+		}
+		entries = append(entries, gitTreeEntry{Blob: fields[2], Path: path})
+	}
+	return entries, nil
+}
+
+// gitConfigAt reads the root config as of the given revision.
+func (ctx *Context) gitConfigAt(rev string) (*Config, error) {
+	b, err := ctx.git("show", rev+":./"+defaultConfigFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s at %s: %v", defaultConfigFilename, rev, err)
+	}
+	return cfg, nil
+}
+
+// gitStagedFile is a file added or modified in the index.
+type gitStagedFile struct {
+	Mode string
+	Blob string
+	Path string
+}
+
+// gitStagedFiles lists the files added or modified in the index under the
+// root directory, with paths relative to the root directory.
+func (ctx *Context) gitStagedFiles() ([]gitStagedFile, error) {
+	out, err := ctx.git("diff", "--cached", "--raw", "-z", "--no-abbrev", "--no-renames", "--relative", "--diff-filter=d")
+	if err != nil {
+		return nil, err
+	}
+
+	// :<old mode> SP <new mode> SP <old object> SP <new object> SP <status> NUL <path> NUL
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	var files []gitStagedFile
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(fields[i])
+		if len(meta) != 5 {
+			continue
+		}
+		files = append(files, gitStagedFile{Mode: meta[1], Blob: meta[3], Path: fields[i+1]})
+	}
+	return files, nil
+}
+
+// gitIndexBlob reads the content of the file at path in the index, with path
+// relative to the root directory.
+func (ctx *Context) gitIndexBlob(path string) ([]byte, bool) {
+	b, err := ctx.git("cat-file", "blob", ":./"+filepath.ToSlash(path))
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// gitPrefix returns the path of the root directory relative to the top level
+// of the repository, with a trailing slash unless it's the top level.
+func (ctx *Context) gitPrefix() (string, error) {
+	out, err := ctx.git("rev-parse", "--show-prefix")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// fromGitPath converts a path relative to the top level of the repository,
+// as git passes to filters and drivers, to a path relative to the root
+// directory.
+func fromGitPath(prefix, path string) string {
+	return filepath.FromSlash(strings.TrimPrefix(filepath.ToSlash(path), prefix))
+}
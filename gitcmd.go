@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newGitCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "git",
+		Short:         "Integrate agec with git",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newGitSetupCmd(ctx),
+	)
+
+	return cmd
+}
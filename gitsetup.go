@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// gitAttributes are the lines of .gitattributes written by `agec git setup`.
+var gitAttributes = []string{
+	"*.age diff=agec",
+	"*.age merge=agec",
+	"*.age" + signatureExt + " merge=agec",
+	defaultConfigFilename + " merge=" + mergeConfigDriver,
+}
+
+// gitConfigEntries are the entries of the local git config written by
+// `agec git setup`. Textconv output is not cached, as the cache would keep
+// plaintext in git notes. The merge drivers merge the plaintext of secrets,
+// and users, groups and secrets of configs.
+var gitConfigEntries = [][2]string{
+	{"diff.agec.textconv", "agec textconv"},
+	{"diff.agec.cachetextconv", "false"},
+	{"merge.agec.name", "agec merge of secrets"},
+	{"merge.agec.driver", "agec merge-driver %O %A %B %P"},
+	{"merge.agec-config.name", "agec merge of " + defaultConfigFilename},
+	{"merge.agec-config.driver", "agec merge-config %O %A %B"},
+}
+
+// gitFilterConfigEntries are the entries of the local git config written by
+// `agec git setup --filter`. The filter is required, so that plaintext isn't
+// stored if agec can't be run.
+var gitFilterConfigEntries = [][2]string{
+	{"filter.agec.process", "agec filter process"},
+	{"filter.agec.clean", "agec filter clean %f"},
+	{"filter.agec.smudge", "agec filter smudge %f"},
+	{"filter.agec.required", "true"},
+}
+
+type gitSetupOpt struct {
+	Filter bool
+
+	ctx *Context
+}
+
+func runGitSetup(opts *gitSetupOpt) error {
+	ctx := opts.ctx
+
+	attributes := append([]string{}, gitAttributes...)
+	entries := append([][2]string{}, gitConfigEntries...)
+
+	if opts.Filter {
+		if err := convertToFilter(ctx); err != nil {
+			return err
+		}
+		for _, secret := range ctx.Config.Secrets {
+			attributes = append(attributes, filterAttribute(secret.Path))
+		}
+		entries = append(entries, gitFilterConfigEntries...)
+	}
+
+	if err := addGitAttributes(ctx, attributes); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, err := ctx.git("config", "--local", entry[0], entry[1]); err != nil {
+			return err
+		}
+		fmt.Printf("set git config %s to %q\n", entry[0], entry[1])
+	}
+
+	if opts.Filter && !ctx.Config.Filter {
+		ctx.Config.Filter = true
+		return ctx.WriteConfigFile()
+	}
+	return nil
+}
+
+// addGitAttributes adds the lines to .gitattributes of the root directory,
+// unless they already exist.
+func addGitAttributes(ctx *Context, lines []string) error {
+	path := filepath.Join(ctx.RootDir, ".gitattributes")
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	content := string(b)
+	existing := strings.Split(content, "\n")
+	var added []string
+	for _, line := range lines {
+		if !lo.Contains(existing, line) && !lo.Contains(added, line) {
+			added = append(added, line)
+		}
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += strings.Join(added, "\n") + "\n"
+	if err := WriteFile(path, []byte(content)); err != nil {
+		return err
+	}
+
+	for _, line := range added {
+		fmt.Printf("added %q to .gitattributes\n", line)
+	}
+	return nil
+}
+
+// convertToFilter replaces the links to decrypted secrets with their
+// plaintext, and removes their encrypted files, which the filter replaces.
+// All of the encrypted secrets must be decrypted first.
+func convertToFilter(ctx *Context) error {
+	if err := checkFilterWriters(ctx.Config); err != nil {
+		return err
+	}
+
+	var encrypted []Secret
+	var missing []string
+	for _, secret := range ctx.Config.Secrets {
+		if secret.Mode == secretModeThreshold {
+			return fmt.Errorf("%q is a threshold secret, which the filter can't store", secret.Path)
+		}
+
+		if !fileExists(filepath.Join(ctx.RootDir, secret.Path+".age")) {
+			continue
+		}
+		encrypted = append(encrypted, secret)
+		if !fileExists(filepath.Join(ctx.SecretStorePath, secret.Path)) {
+			missing = append(missing, secret.Path)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("secrets to store with the filter are not decrypted, decrypt them first: %s", strings.Join(missing, ", "))
+	}
+
+	for _, secret := range encrypted {
+		plaintext, err := os.ReadFile(filepath.Join(ctx.SecretStorePath, secret.Path))
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(ctx.RootDir, secret.Path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.WriteFile(path, plaintext, 0o600); err != nil {
+			return err
+		}
+
+		encryptedFile := secret.Path + ".age"
+		files := []string{encryptedFile, encryptedFile + signatureExt}
+		if _, err := ctx.git(append([]string{"rm", "-q", "--cached", "--ignore-unmatch", "--"}, files...)...); err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := os.Remove(filepath.Join(ctx.RootDir, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		fmt.Printf("%q is stored with the filter, stage it with `git add %s`\n", secret.Path, secret.Path)
+	}
+	return nil
+}
+
+func newGitSetupCmd(ctx *Context) *cobra.Command {
+	opts := &gitSetupOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Set up git to show the plaintext of secrets in diffs and merge them",
+		Long: `Add the attributes of encrypted files to .gitattributes, and set up the diff
+and merge drivers in the local git config, so that git diff and git log -p
+show the plaintext of secrets you can decrypt, and git merge merges their
+plaintext and the users, groups and secrets of .agec.yaml, and signs the
+merged encrypted files. .gitattributes is shared by commits, but the local
+git config has to be set up in each clone.
+
+With --filter, secrets are stored by a git filter instead, for tools which
+don't follow links. The working tree holds their plaintext, and git stores
+them encrypted in place of .age files. Decrypted secrets are converted, and
+new secrets are added to .gitattributes by 'agec encrypt'. Threshold secrets
+and writers of secrets are not supported by the filter, so it's refused if
+.agec.yaml has writers rules.`,
+		Example: `  agec git setup
+  git add .gitattributes
+
+  # store secrets with the git filter
+  agec git setup --filter
+  git add .gitattributes .agec.yaml
+  git add $(agec ls)`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGitSetup(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVar(&opts.Filter, "filter", false, "Store secrets with a git filter instead of links to their plaintext")
+
+	return cmd
+}
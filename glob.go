@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// matchPattern reports whether the slash separated path matches the glob
+// pattern. In addition to the syntax of path.Match, "**" matches any number
+// of directories.
+func matchPattern(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				ok, err := matchSegments(pattern[1:], name[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return false, nil
+		}
+
+		ok, err := path.Match(pattern[0], name[0])
+		if !ok || err != nil {
+			return false, err
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
@@ -5,14 +5,15 @@ import (
 )
 
 type groupaddOpt struct {
-	Group string
-	Users []string
+	Group  string
+	Users  []string
+	Groups []string
 
 	ctx *Context
 }
 
 func runGroupadd(opts *groupaddOpt) error {
-	err := opts.ctx.Config.AddGroup(opts.Group, opts.Users)
+	err := opts.ctx.Config.AddGroup(opts.Group, opts.Users, opts.Groups)
 	if err != nil {
 		return err
 	}
@@ -27,7 +28,10 @@ func newGroupAddCmd(ctx *Context) *cobra.Command {
 		Use:   "groupadd",
 		Short: "Creates agec group",
 		Example: `  # add group devops with user john, merry
-  agec groupadd devops -u john,merry`,
+  agec groupadd devops -u john,merry
+
+  # members of backend, frontend are also members of engineering
+  agec groupadd engineering -G backend,frontend`,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -50,5 +54,8 @@ func newGroupAddCmd(ctx *Context) *cobra.Command {
 	f.StringSliceVarP(&opts.Users, "user", "u", nil, "List of users")
 	cmd.RegisterFlagCompletionFunc("user", UserCompletion(ctx))
 
+	f.StringSliceVarP(&opts.Groups, "group", "G", nil, "List of nested groups")
+	cmd.RegisterFlagCompletionFunc("group", GroupCompletion(ctx))
+
 	return cmd
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
@@ -8,6 +10,7 @@ import (
 type groupModOpt struct {
 	Group  string
 	Users  []string
+	Groups []string
 	Append bool
 
 	ctx *Context
@@ -20,11 +23,43 @@ func runGroupMod(opts *groupModOpt) error {
 		return err
 	}
 
-	if opts.Append {
-		g.Members = append(g.Members, opts.Users...)
-		g.Members = lo.Uniq(g.Members)
-	} else {
-		g.Members = opts.Users
+	before, err := ctx.Config.Clone()
+	if err != nil {
+		return err
+	}
+
+	// only nested groups are modified if -G is given without -u
+	if opts.Users != nil || opts.Groups == nil {
+		if opts.Append {
+			g.Members = append(g.Members, opts.Users...)
+			g.Members = lo.Uniq(g.Members)
+		} else {
+			g.Members = opts.Users
+		}
+	}
+
+	if opts.Groups != nil {
+		for _, group := range opts.Groups {
+			if !ctx.Config.GroupExists(group) {
+				return fmt.Errorf("group %q not exists", group)
+			}
+		}
+
+		if opts.Append {
+			g.Groups = lo.Uniq(append(g.Groups, opts.Groups...))
+		} else {
+			g.Groups = opts.Groups
+		}
+	}
+
+	ctx.Config.SaveGroup(g)
+
+	if _, err := ctx.Config.GroupMembers(g.Name); err != nil {
+		return err
+	}
+
+	if err := ctx.Config.CheckAccessPolicies(policyAffectedSecrets(before, ctx.Config)); err != nil {
+		return err
 	}
 
 	return opts.ctx.WriteConfigFile()
@@ -41,7 +76,10 @@ func newGroupModCmd(ctx *Context) *cobra.Command {
   agec groupmod -u john devops
   
   # append member "john" to "devops" group
-  agec groupmod -u john -a devops`,
+  agec groupmod -u john -a devops
+
+  # members of "sre" are also members of "devops"
+  agec groupmod -G sre -a devops`,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -62,6 +100,9 @@ func newGroupModCmd(ctx *Context) *cobra.Command {
 	f.StringSliceVarP(&opts.Users, "user", "u", nil, "List of users")
 	cmd.RegisterFlagCompletionFunc("user", UserCompletion(ctx))
 
-	f.BoolVarP(&opts.Append, "append", "a", false, "Append users to the existing member list, rather than replacing it")
+	f.StringSliceVarP(&opts.Groups, "group", "G", nil, "List of nested groups")
+	cmd.RegisterFlagCompletionFunc("group", NestedGroupCompletion(ctx))
+
+	f.BoolVarP(&opts.Append, "append", "a", false, "Append users or nested groups to the existing list, rather than replacing it")
 	return cmd
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const ageIntro = "age-encryption.org/v1"
+
+// stanza is a recipient stanza of an age header, without its body.
+type stanza struct {
+	Type string
+	Args []string
+}
+
+// readStanzas parses the recipient stanzas in the header of an age file,
+// without decrypting it.
+func readStanzas(r io.Reader) ([]stanza, error) {
+	br := bufio.NewReader(r)
+
+	intro, err := br.ReadString('\n')
+	if err != nil || strings.TrimSuffix(intro, "\n") != ageIntro {
+		return nil, errors.New("not an age encrypted file")
+	}
+
+	var stanzas []stanza
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("malformed age header: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "---"):
+			return stanzas, nil
+		case strings.HasPrefix(line, "-> "):
+			fields := strings.Fields(strings.TrimPrefix(line, "-> "))
+			if len(fields) == 0 {
+				return nil, errors.New("malformed age header: empty stanza")
+			}
+			stanzas = append(stanzas, stanza{Type: fields[0], Args: fields[1:]})
+		}
+	}
+}
+
+// sshKeyTag returns the tag that agessh stores in stanzas wrapped for the SSH
+// public key, or an empty string if key is not an SSH key.
+func sshKeyTag(key string) (string, error) {
+	if !strings.HasPrefix(key, "ssh-") {
+		return "", nil
+	}
+
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(pk.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4]), nil
+}
+
+// stanzasHaveTag reports whether any SSH stanza is tagged with tag.
+func stanzasHaveTag(stanzas []stanza, tag string) bool {
+	for _, s := range stanzas {
+		if (s.Type == "ssh-ed25519" || s.Type == "ssh-rsa") && len(s.Args) > 0 && s.Args[0] == tag {
+			return true
+		}
+	}
+	return false
+}
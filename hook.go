@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// hookMarker marks git hooks installed by agec, which can be replaced.
+const hookMarker = "# installed by agec"
+
+// hookNames are the git hooks installed by `agec hook install`.
+var hookNames = []string{"pre-commit", "post-merge", "post-checkout"}
+
+func newHookCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "hook",
+		Short:         "Install and run git hooks",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newHookInstallCmd(ctx),
+		newHookPreCommitCmd(ctx),
+		newHookPostMergeCmd(ctx),
+		newHookPostCheckoutCmd(ctx),
+	)
+
+	return cmd
+}
+
+func hookScript(name string) string {
+	return fmt.Sprintf("#!/bin/sh\n%s\nexec agec hook %s \"$@\"\n", hookMarker, name)
+}
+
+// hooksDir returns the directory of git hooks, which may be moved by
+// core.hooksPath.
+func (ctx *Context) hooksDir() (string, error) {
+	out, err := ctx.git("rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+
+	dir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(ctx.RootDir, dir)
+	}
+	return dir, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type hookInstallOpt struct {
+	Force bool
+
+	ctx *Context
+}
+
+func runHookInstall(opts *hookInstallOpt) error {
+	ctx := opts.ctx
+
+	dir, err := ctx.hooksDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, name := range hookNames {
+		path := filepath.Join(dir, name)
+
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil && !strings.Contains(string(b), hookMarker) && !opts.Force {
+			return fmt.Errorf("%q already exists, call `agec hook %s` from it or pass --force to replace it", path, name)
+		}
+
+		if err := os.WriteFile(path, []byte(hookScript(name)), 0o755); err != nil {
+			return err
+		}
+		// WriteFile keeps the mode of an existing file
+		if err := os.Chmod(path, 0o755); err != nil {
+			return err
+		}
+		fmt.Printf("installed %q\n", path)
+	}
+	return nil
+}
+
+func newHookInstallCmd(ctx *Context) *cobra.Command {
+	opts := &hookInstallOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install git hooks which run agec",
+		Long: `Install git hooks which run agec in the repository of the root config. Hooks
+which were not installed by agec are left as they are, unless --force is
+passed.`,
+		Example:       `  agec hook install`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runHookInstall(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&opts.Force, "force", "f", false, "Replace existing hooks which were not installed by agec")
+
+	return cmd
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type hookPostCheckoutOpt struct {
+	PrevHead string
+	NewHead  string
+	Branch   bool
+
+	ctx *Context
+}
+
+func runHookPostCheckout(opts *hookPostCheckoutOpt) error {
+	// checking out files doesn't move HEAD, and a clone has nothing decrypted
+	if !opts.Branch || opts.PrevHead == opts.NewHead || strings.Trim(opts.PrevHead, "0") == "" {
+		return nil
+	}
+	return refreshDecrypted(opts.ctx, opts.PrevHead, opts.NewHead)
+}
+
+func newHookPostCheckoutCmd(ctx *Context) *cobra.Command {
+	opts := &hookPostCheckoutOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "post-checkout <previous HEAD> <new HEAD> <branch checkout>",
+		Short: "Decrypt secrets changed by a checkout again",
+		Long: `Decrypt the secrets whose encrypted files differ between the previous and
+the new HEAD again, run by the post-checkout hook of 'agec hook install'.
+Only secrets which are decrypted and have no local changes are decrypted
+again, local changes are kept with a warning.`,
+		Example: `  # decrypt secrets which differ from the previous branch again
+  agec hook post-checkout @{-1} HEAD 1`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(3),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.PrevHead, opts.NewHead = args[0], args[1]
+			opts.Branch = args[2] == "1"
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runHookPostCheckout(opts)
+		},
+	}
+
+	return cmd
+}
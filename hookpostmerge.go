@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+type hookPostMergeOpt struct {
+	Squash bool
+
+	ctx *Context
+}
+
+func runHookPostMerge(opts *hookPostMergeOpt) error {
+	// a squash merge doesn't move HEAD, the merged changes are in the index
+	if opts.Squash {
+		return refreshDecrypted(opts.ctx, "HEAD", "")
+	}
+	return refreshDecrypted(opts.ctx, "ORIG_HEAD", "HEAD")
+}
+
+// refreshDecrypted decrypts again the secrets whose encrypted files changed
+// between oldRev and newRev, or the index if newRev is empty, and which are
+// decrypted without local changes. Secrets with local changes are left as
+// they are with a warning. As hooks run after git is done, problems are only
+// logged.
+func refreshDecrypted(ctx *Context, oldRev, newRev string) error {
+	args := []string{"diff", "--name-only", "-z", "--no-renames", "--relative", "--diff-filter=d"}
+	if newRev == "" {
+		args = append(args, "--cached", oldRev)
+	} else {
+		args = append(args, oldRev, newRev)
+	}
+	out, err := ctx.git(args...)
+	if err != nil {
+		return err
+	}
+
+	changed := map[string]bool{}
+	for _, path := range strings.Split(string(out), "\x00") {
+		path = strings.TrimSuffix(path, sharesExt)
+		if strings.HasSuffix(path, ".age") {
+			changed[strings.TrimSuffix(path, ".age")] = true
+		}
+	}
+
+	var identities []age.Identity
+	var identitiesErr error
+	loaded := false
+
+	for _, secret := range ctx.Config.Secrets {
+		if !changed[filepath.ToSlash(secret.Path)] {
+			continue
+		}
+
+		plaintext, err := os.ReadFile(filepath.Join(ctx.SecretStorePath, secret.Path))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !loaded {
+			identities, identitiesErr = loadIdentities(os.Getenv("AGEC_IDENTITY"))
+			loaded = true
+		}
+
+		modified, err := hasLocalChanges(ctx, secret, oldRev, plaintext, identities)
+		if err != nil {
+			log.Printf("WARNING: %q was not decrypted again, can't tell whether it has local changes: %v", secret.Path, err)
+			continue
+		}
+		if modified {
+			log.Printf("WARNING: %q has local changes, which conflict with its changed encrypted file. Encrypt them with `agec encrypt --force %s`, or discard them with `agec decrypt --force %s.age`", secret.Path, secret.Path, secret.Path)
+			continue
+		}
+
+		if identitiesErr != nil {
+			log.Printf("WARNING: %q was not decrypted again: %v", secret.Path, identitiesErr)
+			continue
+		}
+
+		file, err := filepath.Rel(ctx.WorkingDir, filepath.Join(ctx.RootDir, secret.Path+".age"))
+		if err != nil {
+			return err
+		}
+
+		err = runDecrypt(&decryptOpt{
+			FileArg:    file,
+			Force:      true,
+			Identities: identities,
+			ctx:        ctx,
+		})
+		if err != nil {
+			log.Printf("WARNING: %q was not decrypted again: %v", secret.Path, err)
+		}
+	}
+	return nil
+}
+
+// hasLocalChanges reports whether the decrypted plaintext of the secret
+// differs from the content of its encrypted file at rev. The recorded digest
+// is used if it's of that encrypted file, otherwise it's decrypted.
+func hasLocalChanges(ctx *Context, secret Secret, rev string, plaintext []byte, identities []age.Identity) (bool, error) {
+	ciphertext, err := ctx.git("cat-file", "blob", rev+":./"+filepath.ToSlash(secret.Path)+".age")
+	if err != nil {
+		// the secret is new, any decrypted plaintext is local
+		return true, nil
+	}
+	shares, _ := ctx.git("cat-file", "blob", rev+":./"+filepath.ToSlash(secret.Path)+".age"+sharesExt)
+
+	records, err := ctx.readEncryptRecords()
+	if err != nil {
+		return false, err
+	}
+	if record, ok := records[filepath.ToSlash(secret.Path)]; ok && record.Ciphertext == ciphertextDigest(ciphertext, shares) {
+		digest, err := ctx.plaintextDigest(plaintext)
+		if err != nil {
+			return false, err
+		}
+		return record.Plaintext != digest, nil
+	}
+
+	if secret.Mode == secretModeThreshold {
+		return false, errors.New("threshold secrets can't be decrypted without shares")
+	}
+	if len(identities) == 0 {
+		return false, errors.New("no identities to decrypt it")
+	}
+
+	old, err := decryptSecret(secret, "", ciphertext, identities, nil)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(old, plaintext), nil
+}
+
+func newHookPostMergeCmd(ctx *Context) *cobra.Command {
+	opts := &hookPostMergeOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "post-merge [squash]",
+		Short: "Decrypt secrets changed by a merge again",
+		Long: `Decrypt the secrets whose encrypted files were changed by a merge or pull
+again, run by the post-merge hook of 'agec hook install'. Only secrets which
+are decrypted and have no local changes are decrypted again, local changes
+are kept with a warning.`,
+		Example: `  # decrypt secrets changed by the last merge again
+  agec hook post-merge`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.Squash = len(args) == 1 && args[0] == "1"
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runHookPostMerge(opts)
+		},
+	}
+
+	return cmd
+}
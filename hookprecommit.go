@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type hookPreCommitOpt struct {
+	ctx *Context
+}
+
+func runHookPreCommit(opts *hookPreCommitOpt) error {
+	ctx := opts.ctx
+
+	staged, err := ctx.gitStagedFiles()
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := decryptedBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var problems []checkProblem
+	for _, f := range staged {
+		if _, err := ctx.Config.GetSecret(f.Path); err == nil {
+			// the filter stages secrets encrypted in place
+			if ctx.Config.Filter {
+				if !ctx.stagedEncrypted(f) {
+					problems = append(problems, checkProblem{
+						Path:    f.Path,
+						Message: "plaintext of a secret is staged, the filter is not set up in this clone. Run `agec git setup --filter`",
+					})
+				}
+				continue
+			}
+			problems = append(problems, checkProblem{
+				Path:    f.Path,
+				Message: fmt.Sprintf("plaintext of a secret is staged, unstage it with `git rm --cached %s`", f.Path),
+			})
+			continue
+		}
+
+		if secret, ok := decrypted[f.Blob]; ok {
+			problems = append(problems, checkProblem{
+				Path:    f.Path,
+				Message: fmt.Sprintf("has the content of decrypted secret %q", secret),
+			})
+			continue
+		}
+
+		b, err := ctx.git("cat-file", "blob", f.Blob)
+		if err != nil {
+			return err
+		}
+
+		// symlinks are staged as their target
+		if f.Mode == "120000" && ctx.inSecretStore(filepath.Dir(f.Path), string(b)) {
+			problems = append(problems, checkProblem{
+				Path:    f.Path,
+				Message: "links to a decrypted secret",
+			})
+			continue
+		}
+
+		if strings.HasSuffix(f.Path, ".age") {
+			if _, err := readStanzas(bytes.NewReader(b)); err != nil {
+				problems = append(problems, checkProblem{
+					Path:    f.Path,
+					Message: fmt.Sprintf("can't be parsed as age: %v", err),
+				})
+			}
+		}
+	}
+
+	conflicts, err := ctx.readConflicts()
+	if err != nil {
+		return err
+	}
+	for _, path := range conflicts {
+		file := path + ".age"
+		if ctx.Config.Filter {
+			file = path
+		}
+		// resolving with either side leaves it unchanged in the index
+		if _, ok := ctx.gitIndexBlob(file); ok {
+			problems = append(problems, checkProblem{
+				Path:    file,
+				Message: fmt.Sprintf("has unresolved conflicts of a merge, resolve them and run `agec encrypt --force %s`, or discard them with `agec decrypt --force %s.age`", path, path),
+			})
+		}
+	}
+
+	for _, secret := range ctx.Config.Secrets {
+		encryptedFile := secret.Path + ".age"
+		ciphertext, ok := ctx.gitIndexBlob(encryptedFile)
+		if !ok {
+			continue
+		}
+		shares, _ := ctx.gitIndexBlob(encryptedFile + sharesExt)
+
+		stale, err := ctx.staleCiphertext(secret, ciphertext, shares)
+		if err != nil {
+			return err
+		}
+		if stale {
+			problems = append(problems, checkProblem{
+				Path:    encryptedFile,
+				Message: fmt.Sprintf("is stale, the secret changed since it was encrypted. Run `agec encrypt --force %s` and stage it", secret.Path),
+			})
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", p.Path, p.Message)
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("refusing to commit, found %d problem(s). Pass --no-verify to git commit to skip this check", len(problems))
+	}
+	return nil
+}
+
+func (ctx *Context) stagedEncrypted(f gitStagedFile) bool {
+	b, err := ctx.git("cat-file", "blob", f.Blob)
+	if err != nil {
+		return false
+	}
+	_, err = readStanzas(bytes.NewReader(b))
+	return err == nil
+}
+
+// decryptedBlobs returns the paths of decrypted secrets by the git object id
+// of their content, to find copies of them. With the filter, the plaintext of
+// secrets in the working tree is included.
+func decryptedBlobs(ctx *Context) (map[string]string, error) {
+	var paths, names []string
+	err := filepath.WalkDir(ctx.SecretStorePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		// empty files are too common to be told apart from empty secrets
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ctx.SecretStorePath, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if ctx.Config.Filter {
+		for _, secret := range ctx.Config.Secrets {
+			path := filepath.Join(ctx.RootDir, secret.Path)
+			b, err := os.ReadFile(path)
+			if err != nil || len(b) == 0 {
+				continue
+			}
+			// secrets which can't be decrypted are checked out encrypted
+			if _, err := readStanzas(bytes.NewReader(b)); err == nil {
+				continue
+			}
+			paths = append(paths, path)
+			names = append(names, secret.Path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	blobs, err := ctx.gitLines(append([]string{"hash-object", "--no-filters", "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := map[string]string{}
+	for i, blob := range blobs {
+		decrypted[blob] = names[i]
+	}
+	return decrypted, nil
+}
+
+// inSecretStore reports whether a symlink in dir, relative to the root
+// directory, to target resolves into the store of decrypted secrets.
+func (ctx *Context) inSecretStore(dir string, target string) bool {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(ctx.RootDir, dir, target)
+	}
+
+	rel, err := filepath.Rel(ctx.SecretStorePath, filepath.Clean(target))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func newHookPreCommitCmd(ctx *Context) *cobra.Command {
+	opts := &hookPreCommitOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "pre-commit",
+		Short: "Refuse to commit plaintext of secrets",
+		Long: `Check the staged changes before a commit, run by the pre-commit hook of
+'agec hook install'. The commit is refused if
+
+  - plaintext of a secret is staged, or a copy of it
+  - a link into the decrypted secrets is staged
+  - a staged .age file can't be parsed as age
+  - the encrypted file of a secret is stale, as its plaintext or recipients
+    changed since it was encrypted`,
+		Example: `  # check the staged changes without committing
+  agec hook pre-commit`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runHookPreCommit(opts)
+		},
+	}
+
+	return cmd
+}
@@ -5,13 +5,16 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"time"
 
 	"filippo.io/age"
 	"github.com/spf13/cobra"
 )
 
 type initOpt struct {
+	KeyFile    string
+	Passphrase bool
+	NoRoot     bool
+
 	out io.Writer
 
 	ctx *Context
@@ -31,42 +34,50 @@ func runInit(opts *initOpt) error {
 		}
 	}
 
+	ctx := &Context{}
+	ctx.RootDir = wd
+	ctx.RootConfig = rootConfig
+	ctx.Config = &Config{
+		Version: "v1",
+		Users:   []User{},
+		Secrets: []Secret{},
+		Groups:  []Group{},
+	}
+
+	if opts.NoRoot {
+		fmt.Fprintf(os.Stderr, "Initalized agec in %q\n", rootConfig)
+		return ctx.WriteConfigFile()
+	}
+
 	k, err := age.GenerateX25519Identity()
 	if err != nil {
 		return err
 	}
 
-	root := User{
-		Name: "root",
-		Recipients: []string{
-			k.Recipient().String(),
+	ctx.Config.Users = []User{
+		{
+			Name: rootUser,
+			Recipients: newRecipients([]string{
+				k.Recipient().String(),
+			}),
 		},
 	}
-
-	ctx := &Context{}
-	ctx.RootDir = wd
-	ctx.RootConfig = rootConfig
-	ctx.Config = &Config{
-		Version: "v1",
-		Users: []User{
-			root,
-		},
-		Secrets: []Secret{},
-		Groups: []Group{
-			{
-				Name: "root",
-				Members: []string{
-					"root",
-				},
+	ctx.Config.Groups = []Group{
+		{
+			Name: rootUser,
+			Members: []string{
+				rootUser,
 			},
 		},
 	}
 
+	// the key is written first, so the config is never created without it
+	if err := writeRootKey(k, opts.KeyFile, opts.Passphrase); err != nil {
+		return err
+	}
+
 	fmt.Fprintf(os.Stderr, "Initalized agec in %q\n", rootConfig)
 	fmt.Fprintf(os.Stderr, "\nGenerated user:root, group:root\n")
-	fmt.Fprintf(os.Stdout, "# created: %s\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(os.Stdout, "# public key: %s\n", k.Recipient())
-	fmt.Fprintf(os.Stdout, "%s\n", k)
 	return ctx.WriteConfigFile()
 }
 
@@ -75,8 +86,19 @@ func newInitCmd(ctx *Context) *cobra.Command {
 		ctx: ctx,
 	}
 	cmd := &cobra.Command{
-		Use:           "init",
-		Short:         "Initalizes agec under the current directory",
+		Use:   "init",
+		Short: "Initalizes agec under the current directory",
+		Long: `Initalizes agec under the current directory, with user "root" and group
+"root". The private key of user "root" is printed to stdout once, unless it's
+written to a file.`,
+		Example: `  # write the key of user "root" to a file, readable only by you
+  agec init --key-file ~/.config/agec/root.key
+
+  # encrypt the key of user "root" to a passphrase
+  agec init --key-file root.key.age --passphrase
+
+  # don't create user "root"
+  agec init --no-root`,
 		SilenceUsage:  true,
 		SilenceErrors: false,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -86,5 +108,11 @@ func newInitCmd(ctx *Context) *cobra.Command {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		},
 	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.KeyFile, "key-file", "o", "", "Write the key of user root to the file instead of stdout")
+	f.BoolVarP(&opts.Passphrase, "passphrase", "p", false, "Encrypt the key of user root to a passphrase, read from AGEC_PASSPHRASE or the terminal")
+	f.BoolVar(&opts.NoRoot, "no-root", false, "Don't create user and group root")
+
 	return cmd
 }
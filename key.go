@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newKeyCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "key",
+		Aliases:       []string{"keys"},
+		Short:         "Manage public keys of users",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newKeyAddCmd(ctx),
+		newKeyRmCmd(ctx),
+		newKeyLsCmd(ctx),
+		newKeySyncCmd(ctx),
+		newKeyRevokeCmd(ctx),
+	)
+
+	return cmd
+}
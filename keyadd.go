@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type keyAddOpt struct {
+	User           string
+	Device         string
+	Comment        string
+	Recipients     []string
+	RecipientsFile string
+
+	ctx *Context
+}
+
+func runKeyAdd(opts *keyAddOpt) error {
+	cfg := opts.ctx.Config
+
+	if opts.Device != "" && len(opts.Recipients) != 1 {
+		return fmt.Errorf("expected a single key for device %q, got %d", opts.Device, len(opts.Recipients))
+	}
+
+	if err := cfg.CheckRevoked(opts.Recipients); err != nil {
+		return err
+	}
+
+	for _, key := range opts.Recipients {
+		err := cfg.AddRecipient(opts.User, Recipient{
+			Key:     key,
+			Device:  opts.Device,
+			Added:   time.Now().Format("2006-01-02"),
+			Comment: opts.Comment,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.CheckKeyPolicy(opts.Recipients); err != nil {
+		return err
+	}
+
+	fmt.Printf("added %d key(s) to user %q\n", len(opts.Recipients), opts.User)
+	return opts.ctx.WriteConfigFile()
+}
+
+func newKeyAddCmd(ctx *Context) *cobra.Command {
+	opts := &keyAddOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add public keys to a user",
+		Example: `  # add the key of a new laptop to "aca"
+  cat ~/.ssh/id_ed25519.pub | agec key add aca --device laptop2 -R -`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			if opts.RecipientsFile == "" {
+				return errors.New("specify recipients-file for the user")
+			}
+
+			var err error
+			opts.Recipients, err = readRecipientsFile(opts.RecipientsFile)
+			if err != nil {
+				return err
+			}
+
+			opts.User = args[0]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyAdd(opts)
+		},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: UserCompletion(ctx),
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.Device, "device", "d", "", "Name of the device the key belongs to")
+	f.StringVarP(&opts.Comment, "comment", "c", "", "Comment for the key")
+	f.StringVarP(&opts.RecipientsFile, "recipients-file", "R", "", "User's recipients, if set to -, the recipients are read from standard input.")
+
+	return cmd
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+type keyLsOpt struct {
+	User string
+
+	ctx *Context
+}
+
+func runKeyLs(opts *keyLsOpt) error {
+	u, err := opts.ctx.Config.GetUser(opts.User)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tADDED\tFINGERPRINT\tCOMMENT")
+	for _, rec := range u.Recipients {
+		fingerprint, err := keyFingerprint(rec.Key)
+		if err != nil {
+			fingerprint = rec.Key
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", orDash(rec.Device), orDash(rec.Added), fingerprint, orDash(rec.Comment))
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newKeyLsCmd(ctx *Context) *cobra.Command {
+	opts := &keyLsOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:           "ls",
+		Short:         "List public keys of a user",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			opts.User = args[0]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyLs(opts)
+		},
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: UserCompletion(ctx),
+	}
+
+	return cmd
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type keyRevokeOpt struct {
+	Fingerprint string
+
+	ctx *Context
+}
+
+func runKeyRevoke(opts *keyRevokeOpt) error {
+	cfg := opts.ctx.Config
+
+	err := cfg.RevokeKey(opts.Fingerprint)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("revoked key %q\n", opts.Fingerprint)
+
+	for _, u := range cfg.Users {
+		for _, key := range u.Keys() {
+			if cfg.IsRevoked(key) {
+				log.Printf("user %q still has the revoked key, update it with `agec usermod %s -R`", u.Name, u.Name)
+			}
+		}
+	}
+
+	return opts.ctx.WriteConfigFile()
+}
+
+func newKeyRevokeCmd(ctx *Context) *cobra.Command {
+	opts := &keyRevokeOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke a compromised public key",
+		Example: `  # revoke by public key
+  agec key revoke "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHcOxFPXarxSbKwGUj6bTlxVec6LoPJQKPnVd/p7Zljq"
+
+  # revoke by fingerprint, as printed by ssh-keygen -l
+  agec key revoke SHA256:HU0NNTRIS8GRLDR5s7xxVjfY5ynVv4nZB3DG4L16Mfw
+
+  # find secrets which are still encrypted to revoked keys
+  agec check`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			if strings.HasPrefix(args[0], sshFingerprintPrefix) {
+				if _, err := fingerprintTag(args[0]); err != nil {
+					return err
+				}
+				opts.Fingerprint = args[0]
+				return nil
+			}
+
+			var err error
+			opts.Fingerprint, err = keyFingerprint(args[0])
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyRevoke(opts)
+		},
+		Args: cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+
+	return cmd
+}
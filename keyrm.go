@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+type keyRmOpt struct {
+	User string
+	Key  string
+
+	ctx *Context
+}
+
+func runKeyRm(opts *keyRmOpt) error {
+	rec, err := opts.ctx.Config.RemoveRecipient(opts.User, opts.Key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed key %q from user %q\n", rec.Key, opts.User)
+	return opts.ctx.WriteConfigFile()
+}
+
+func newKeyRmCmd(ctx *Context) *cobra.Command {
+	opts := &keyRmOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "rm",
+		Short: "Remove a public key from a user",
+		Example: `  # remove the key of a lost laptop
+  agec key rm aca laptop1
+
+  # remove a key by fingerprint
+  agec key rm aca SHA256:HU0NNTRIS8GRLDR5s7xxVjfY5ynVv4nZB3DG4L16Mfw`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			opts.User = args[0]
+			opts.Key = args[1]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyRm(opts)
+		},
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: DeviceCompletion(ctx),
+	}
+
+	return cmd
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGitHubURL = "https://github.com"
+	defaultGitLabURL = "https://gitlab.com"
+)
+
+// KeySource is where public keys of a user are fetched from, set only one of
+// the fields.
+type KeySource struct {
+	GitHub string `yaml:"github,omitempty"`
+	GitLab string `yaml:"gitlab,omitempty"`
+
+	// URL is a template of the URL to fetch keys from, "{user}" is replaced
+	// by the name of the user.
+	URL string `yaml:"url,omitempty"`
+}
+
+func (s KeySource) IsZero() bool {
+	return s.GitHub == "" && s.GitLab == "" && s.URL == ""
+}
+
+// Validate returns an error if no or more than one source is set.
+func (s KeySource) Validate() error {
+	n := 0
+	for _, v := range []string{s.GitHub, s.GitLab, s.URL} {
+		if v != "" {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return fmt.Errorf("specify exactly one key source, got %d", n)
+	}
+	return nil
+}
+
+func (ctx *Context) keysURL(user string, s KeySource) string {
+	switch {
+	case s.GitHub != "":
+		return fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(ctx.GitHubURL, "/"), s.GitHub)
+	case s.GitLab != "":
+		return fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(ctx.GitLabURL, "/"), s.GitLab)
+	}
+	return strings.ReplaceAll(s.URL, "{user}", user)
+}
+
+// fetchKeys fetches the public keys of the user from the key source.
+func (ctx *Context) fetchKeys(user string, s KeySource) ([]string, error) {
+	url := ctx.keysURL(user, s)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch keys from %q: %s", url, resp.Status)
+	}
+
+	// key sources list all keys of the user, which may be of other types
+	keys, err := scanRecipients(resp.Body, func(err error) bool {
+		var unsupported *unsupportedKeyError
+		if !errors.As(err, &unsupported) {
+			return false
+		}
+		log.Printf("WARNING: skipping %s key of user %q from %q, which age can't encrypt to", unsupported.Type, user, url)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys from %q: %v", url, err)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found at %q", url)
+	}
+	return keys, nil
+}
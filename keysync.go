@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+type keySyncOpt struct {
+	Users  []string
+	DryRun bool
+
+	ctx *Context
+}
+
+func runKeySync(opts *keySyncOpt) error {
+	ctx := opts.ctx
+	cfg := ctx.Config
+
+	users := opts.Users
+	if len(users) == 0 {
+		for _, u := range cfg.Users {
+			if u.Source != nil {
+				users = append(users, u.Name)
+			}
+		}
+	}
+
+	var synced []string
+	for _, name := range users {
+		u, err := cfg.GetUser(name)
+		if err != nil {
+			return err
+		}
+		if u.Source == nil {
+			return fmt.Errorf("user %q has no key source", name)
+		}
+
+		keys, err := ctx.fetchKeys(u.Name, *u.Source)
+		if err != nil {
+			return err
+		}
+
+		keys = lo.Filter(keys, func(key string, _ int) bool {
+			if cfg.IsRevoked(key) {
+				log.Printf("skipping revoked key %q of user %q", key, u.Name)
+				return false
+			}
+			return true
+		})
+
+		recs := u.replaceRecipients(keys)
+		fetched := User{Recipients: recs}
+
+		var diff []string
+		for i, rec := range recs {
+			if u.recipientIndex(rec.Key) == -1 {
+				recs[i].Added = time.Now().Format("2006-01-02")
+				diff = append(diff, "+ "+rec.Key)
+			}
+		}
+		for _, rec := range u.Recipients {
+			if fetched.recipientIndex(rec.Key) == -1 {
+				diff = append(diff, "- "+rec.Key)
+			}
+		}
+
+		if len(diff) == 0 {
+			continue
+		}
+
+		fmt.Printf("user %q:\n", u.Name)
+		for _, line := range diff {
+			fmt.Println(line)
+		}
+
+		synced = append(synced, keys...)
+		u.Recipients = recs
+		cfg.SaveUser(u)
+	}
+
+	if len(synced) == 0 {
+		fmt.Println("keys are up to date")
+		return nil
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+
+	if err := cfg.CheckKeyPolicy(synced); err != nil {
+		return err
+	}
+
+	return ctx.WriteConfigFile()
+}
+
+func newKeySyncCmd(ctx *Context) *cobra.Command {
+	opts := &keySyncOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Update keys of users from their key source",
+		Example: `  # show changes of keys for all users with a key source
+  agec keys sync --dry-run
+
+  # update keys of "aca"
+  agec keys sync aca
+
+  # re-encrypt secrets with updated keys
+  agec ls | xargs agec encrypt --force`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			opts.Users = args
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeySync(opts)
+		},
+		ValidArgsFunction: UserCompletion(ctx),
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&opts.DryRun, "dry-run", "n", false, "Only show changes of keys")
+
+	return cmd
+}
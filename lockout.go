@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"filippo.io/age"
+	"github.com/samber/lo"
+)
+
+// checkLockout returns an error if none of the local identities can decrypt a
+// secret encrypted to recipients, so that the caller doesn't lock themselves
+// out by accident. Without any local identity there's nothing to compare
+// with, so it passes.
+func checkLockout(identities []age.Identity, recipients *SecretRecipients, path string) error {
+	if len(identities) == 0 {
+		return nil
+	}
+
+	// identities can't be compared with recipients, as SSH and plugin
+	// identities don't expose their public key. Decrypt a probe instead, one
+	// for each layer as all of them must be decrypted.
+	probes := recipients.Layers
+	if recipients.Threshold != 0 {
+		probes = [][]age.Recipient{append(lo.Flatten(recipients.Shares), recipients.Recovery...)}
+	}
+
+	for i, recs := range probes {
+		probe, err := encryptBytes(nil, recs)
+		if err != nil {
+			return err
+		}
+		if _, err := decryptBytes(probe, identities...); err == nil {
+			continue
+		}
+
+		if len(probes) > 1 {
+			return fmt.Errorf("none of your identities can decrypt layer %d of %d of %q with its owners, pass --allow-lockout if that's intended", i+1, len(probes), path)
+		}
+		return fmt.Errorf("none of your identities can decrypt %q with its owners, pass --allow-lockout if that's intended", path)
+	}
+	return nil
+}
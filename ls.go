@@ -13,17 +13,27 @@ type lsOpt struct {
 }
 
 func runLs(opts *lsOpt) error {
-	for _, secret := range opts.ctx.Config.Secrets {
-		abs := filepath.Join(opts.ctx.RootDir, secret.Path)
-		if strings.HasPrefix(abs, opts.ctx.WorkingDir) {
-			relpath, err := filepath.Rel(opts.ctx.WorkingDir, abs)
+	for _, relpath := range secretsUnderWorkingDir(opts.ctx) {
+		fmt.Println(relpath)
+	}
+	return nil
+}
+
+// secretsUnderWorkingDir returns paths of secrets under the working directory,
+// relative to it.
+func secretsUnderWorkingDir(ctx *Context) []string {
+	var paths []string
+	for _, secret := range ctx.Config.Secrets {
+		abs := filepath.Join(ctx.RootDir, secret.Path)
+		if strings.HasPrefix(abs, ctx.WorkingDir) {
+			relpath, err := filepath.Rel(ctx.WorkingDir, abs)
 			if err != nil {
-				return err
+				continue
 			}
-			fmt.Println(relpath)
+			paths = append(paths, relpath)
 		}
 	}
-	return nil
+	return paths
 }
 
 func newLsCmd(ctx *Context) *cobra.Command {
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/rogpeppe/go-internal/testscript"
@@ -11,10 +15,12 @@ func TestMain(m *testing.M) {
 	version = "test"
 	os.Exit(testscript.RunMain(m, map[string]func() int{
 		"agec": func() int {
+			log.SetFlags(0)
 			err := cmdMain()
 			if err == nil {
 				return 0
 			}
+			log.Print(err)
 			return 1
 		},
 	}))
@@ -23,5 +29,15 @@ func TestMain(m *testing.M) {
 func TestScript(t *testing.T) {
 	testscript.Run(t, testscript.Params{
 		Dir: "testdata",
+		Setup: func(env *testscript.Env) error {
+			// serves files under $WORK/remote, e.g. keys of GitHub users
+			// from $WORK/remote/github/<user>.keys
+			srv := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(env.WorkDir, "remote"))))
+			env.Defer(srv.Close)
+			env.Setenv("REMOTE_URL", srv.URL)
+			env.Setenv("AGEC_GITHUB_URL", srv.URL+"/github")
+			env.Setenv("AGEC_GITLAB_URL", srv.URL+"/gitlab")
+			return nil
+		},
 	})
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const mergeConfigDriver = "agec-config"
+
+type mergeConfigOpt struct {
+	Base    string
+	Current string
+	Other   string
+}
+
+// runMergeConfig merges the base, ours and theirs versions of a config, and
+// writes the result to the current file. Conflicts are resolved with ours and
+// reported, so that the result is still a valid config.
+func runMergeConfig(opts *mergeConfigOpt) error {
+	var cfgs [3]*Config
+	var current []byte
+	for i, file := range []string{opts.Base, opts.Current, opts.Other} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if file == opts.Current {
+			current = b
+		}
+
+		// the base is empty if both sides added the config
+		cfgs[i] = &Config{}
+		if err := yaml.Unmarshal(b, cfgs[i]); err != nil {
+			return fmt.Errorf("failed to parse %s version of %s: %v", mergeLabels[i], defaultConfigFilename, err)
+		}
+	}
+
+	m := &configMerge{}
+	merged := m.merge(cfgs[0], cfgs[1], cfgs[2])
+
+	// comments and formatting are kept from ours
+	b, err := marshalConfig(merged, current)
+	if err != nil {
+		return err
+	}
+	if err := WriteFile(opts.Current, b); err != nil {
+		return err
+	}
+
+	for _, c := range m.conflicts {
+		log.Printf("CONFLICT: %s, kept ours", c)
+	}
+	if len(m.conflicts) != 0 {
+		return fmt.Errorf("found %d conflict(s) in %s, resolve them and stage it", len(m.conflicts), defaultConfigFilename)
+	}
+	return nil
+}
+
+// configMerge is a three-way merge of configs. Users, groups, secrets and
+// rules are merged as sets keyed by their name, path or pattern, and lists of
+// names and keys as sets. Changes of both sides to anything else conflict,
+// unless they're the same.
+type configMerge struct {
+	conflicts []string
+}
+
+func (m *configMerge) conflict(format string, args ...interface{}) {
+	m.conflicts = append(m.conflicts, fmt.Sprintf(format, args...))
+}
+
+func (m *configMerge) merge(base, ours, theirs *Config) *Config {
+	cfg := &Config{
+		Version: mergeValue(m, "version", base.Version, ours.Version, theirs.Version),
+
+		Users: mergeKeyed(m, "user", base.Users, ours.Users, theirs.Users,
+			func(u User) string { return u.Name },
+			func(base, ours, theirs User) User {
+				ours.Recipients = mergeKeyed(m, "recipient", base.Recipients, ours.Recipients, theirs.Recipients,
+					func(r Recipient) string { return r.Key }, nil)
+				ours.Source = mergeValue(m, fmt.Sprintf("source of user %q", ours.Name), base.Source, ours.Source, theirs.Source)
+				return ours
+			}),
+
+		Groups: mergeKeyed(m, "group", base.Groups, ours.Groups, theirs.Groups,
+			func(g Group) string { return g.Name },
+			func(base, ours, theirs Group) Group {
+				ours.Members = mergeSet(base.Members, ours.Members, theirs.Members)
+				ours.Groups = mergeSet(base.Groups, ours.Groups, theirs.Groups)
+				return ours
+			}),
+
+		// owners of a secret are changed together, different owners conflict
+		Secrets: mergeKeyed(m, "secret", base.Secrets, ours.Secrets, theirs.Secrets,
+			func(s Secret) string { return s.Path }, nil),
+
+		RevokedKeys: mergeSet(base.RevokedKeys, ours.RevokedKeys, theirs.RevokedKeys),
+
+		Policy: Policy{
+			Keys: mergeValue(m, "key policy", base.Policy.Keys, ours.Policy.Keys, theirs.Policy.Keys),
+			Access: mergeKeyed(m, "access rule", base.Policy.Access, ours.Policy.Access, theirs.Policy.Access,
+				func(r AccessRule) string { return r.Pattern }, nil),
+		},
+
+		Rules: mergeKeyed(m, "rule", base.Rules, ours.Rules, theirs.Rules,
+			func(r OwnershipRule) string { return r.Pattern }, nil),
+		Writers: mergeKeyed(m, "writers rule", base.Writers, ours.Writers, theirs.Writers,
+			func(r OwnershipRule) string { return r.Pattern }, nil),
+
+		Filter: mergeValue(m, "filter", base.Filter, ours.Filter, theirs.Filter),
+
+		RecoveryRecipients: mergeKeyed(m, "recovery recipient", base.RecoveryRecipients, ours.RecoveryRecipients, theirs.RecoveryRecipients,
+			func(r RecoveryRecipient) string { return r.Key }, nil),
+
+		Admins: mergeSet(base.Admins, ours.Admins, theirs.Admins),
+	}
+
+	// a signature stays valid only if the signed part is of one side
+	payload := cfg.signedPayload()
+	if bytes.Equal(payload, ours.signedPayload()) {
+		cfg.Signature = ours.Signature
+	} else if bytes.Equal(payload, theirs.signedPayload()) {
+		cfg.Signature = theirs.Signature
+	} else if ours.Signature != "" || theirs.Signature != "" {
+		log.Printf("the merged %s needs to be signed again by an admin with `agec config sign`", defaultConfigFilename)
+	}
+
+	return cfg
+}
+
+// mergeValue returns the side which changed the value, or ours with a
+// conflict if both changed it differently.
+func mergeValue[T any](m *configMerge, name string, base, ours, theirs T) T {
+	switch {
+	case cmp.Equal(ours, theirs), cmp.Equal(theirs, base):
+		return ours
+	case cmp.Equal(ours, base):
+		return theirs
+	}
+	m.conflict("%s was changed differently on both sides", name)
+	return ours
+}
+
+// mergeSet merges lists as sets, keeping the order of ours followed by the
+// elements added by theirs. Elements removed by either side are removed.
+func mergeSet(base, ours, theirs []string) []string {
+	var out []string
+	for _, s := range ours {
+		if lo.Contains(theirs, s) || !lo.Contains(base, s) {
+			out = append(out, s)
+		}
+	}
+	for _, s := range theirs {
+		if !lo.Contains(ours, s) && !lo.Contains(base, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// mergeKeyed merges lists of elements keyed by key, keeping the order of ours
+// followed by the elements added by theirs. Elements changed by both sides
+// are merged by merge, or conflict if it's nil. Elements removed by one side
+// and changed by the other conflict.
+func mergeKeyed[T any](m *configMerge, kind string, base, ours, theirs []T, key func(T) string, merge func(base, ours, theirs T) T) []T {
+	find := func(list []T, k string) (T, bool) {
+		return lo.Find(list, func(v T) bool { return key(v) == k })
+	}
+
+	var keys []string
+	for _, v := range append(append([]T{}, ours...), theirs...) {
+		if !lo.Contains(keys, key(v)) {
+			keys = append(keys, key(v))
+		}
+	}
+
+	var out []T
+	for _, k := range keys {
+		b, inBase := find(base, k)
+		o, inOurs := find(ours, k)
+		t, inTheirs := find(theirs, k)
+
+		same := func(v1 T, in1 bool, v2 T, in2 bool) bool {
+			return in1 == in2 && (!in1 || cmp.Equal(v1, v2))
+		}
+
+		var v T
+		var ok bool
+		switch {
+		case same(o, inOurs, t, inTheirs), same(t, inTheirs, b, inBase):
+			v, ok = o, inOurs
+		case same(o, inOurs, b, inBase):
+			v, ok = t, inTheirs
+		case inOurs && inTheirs && merge != nil:
+			v, ok = merge(b, o, t), true
+		case inOurs && inTheirs:
+			m.conflict("%s %q was changed differently on both sides", kind, k)
+			v, ok = o, true
+		default:
+			m.conflict("%s %q was removed on one side and changed on the other", kind, k)
+			v, ok = lo.Ternary(inOurs, o, t), true
+		}
+
+		if ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func newMergeConfigCmd(ctx *Context) *cobra.Command {
+	opts := &mergeConfigOpt{}
+	cmd := &cobra.Command{
+		Use:   "merge-config <base> <current> <other>",
+		Short: "Merge versions of .agec.yaml for git merge",
+		Long: `Merge the versions of .agec.yaml, as the merge driver set up by
+'agec git setup'. Users, groups, secrets and rules are merged by their name,
+path or pattern, and members of groups, keys of users, revoked keys and admins
+are merged as sets, so that branches adding different secrets or users merge
+cleanly.
+
+Contradictory changes, like different owners of the same secret, are
+reported as conflicts, and ours are kept in the result. The merged config has
+to be signed again if the signed part was changed by both sides.`,
+		Example: `  # in .gitattributes, with 'agec git setup'
+  .agec.yaml merge=agec-config
+
+  # in .git/config
+  [merge "agec-config"]
+      driver = agec merge-config %O %A %B`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(3),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			opts.Base, opts.Current, opts.Other = args[0], args[1], args[2]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMergeConfig(opts)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+const mergeDriver = "agec"
+
+type mergeDriverOpt struct {
+	Base         string
+	Current      string
+	Other        string
+	Path         string
+	IdentityFile string
+
+	ctx *Context
+}
+
+// runMergeDriver merges the decrypted versions of a secret, and writes the
+// result encrypted to its owners to the current file. Conflicts are written
+// in plaintext only where secrets are decrypted, never to the current file of
+// an encrypted file.
+func runMergeDriver(opts *mergeDriverOpt) error {
+	ctx := opts.ctx
+
+	prefix, err := ctx.gitPrefix()
+	if err != nil {
+		return err
+	}
+
+	path := fromGitPath(prefix, opts.Path)
+	if strings.HasSuffix(path, ".age"+signatureExt) {
+		return ctx.mergeSignatureFile(path, opts.Current)
+	}
+
+	secret, err := ctx.Config.GetSecret(strings.TrimSuffix(path, ".age"))
+	if err != nil {
+		secret, err = ctx.Config.GetSecret(path)
+		if err != nil {
+			return fmt.Errorf("%q is not tracked by agec", opts.Path)
+		}
+	}
+	if secret.Mode == secretModeThreshold {
+		return fmt.Errorf("%q is a threshold secret, whose shares can't be merged", secret.Path)
+	}
+
+	if err := ctx.checkConfigTrust(); err != nil {
+		return err
+	}
+
+	identities, err := loadIdentities(opts.IdentityFile)
+	if err != nil {
+		return err
+	}
+
+	// git merges signatures as files of their own, so both sides are verified
+	// with the signatures of the merged commits
+	sigs := ctx.revSignatures(path, append([]string{"HEAD"}, mergedRevs()...))
+
+	// the base is empty if both sides added the secret
+	var versions [3][]byte
+	for i, file := range []string{opts.Base, opts.Current, opts.Other} {
+		ciphertext, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if len(ciphertext) == 0 {
+			continue
+		}
+		if i != 0 && !ctx.Config.Filter {
+			if err := ctx.checkMergeSignature(secret, mergeLabels[i], ciphertext, sigs); err != nil {
+				return err
+			}
+		}
+		versions[i], err = decryptSecret(secret, "", ciphertext, identities, nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s version of %q: %v", mergeLabels[i], secret.Path, err)
+		}
+	}
+	base, ours, theirs := versions[0], versions[1], versions[2]
+
+	merged, conflicted, err := ctx.mergeText(base, ours, theirs)
+	if err != nil {
+		return err
+	}
+
+	if conflicted {
+		return ctx.writeConflict(secret, opts.Current, ours, merged)
+	}
+
+	// a signature left by an earlier merge must not be taken for this one
+	sigPath := ctx.mergedSigPath(path + signatureExt)
+	if err := os.Remove(sigPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// secrets which have writers are left to them, others are signed by
+	// whoever merges them, if they can
+	_, ruled, err := ctx.Config.AllowedWriters(secret)
+	if err != nil {
+		return err
+	}
+	if ruled {
+		return ctx.writeUnsigned(secret, opts.Current, ours, merged, "must be signed by its writers, which the merge can't do")
+	}
+
+	recipients, err := ctx.Config.GetRecipients(secret)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Config.CheckAccessPolicy(secret); err != nil {
+		return err
+	}
+
+	record, err := ctx.newEncryptRecord(secret, merged)
+	if err != nil {
+		return err
+	}
+
+	out, _, err := encryptPlaintext(merged, recipients)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Config.Filter {
+		sig, err := signSecret(ctx.Config, secret, out, nil, opts.IdentityFile, false)
+		if err != nil {
+			return err
+		}
+		if sig == nil && ctx.signatureRequired(ctx.Config, secret) {
+			return ctx.writeUnsigned(secret, opts.Current, ours, merged, "must be signed, which none of your ssh keys can do")
+		}
+		if sig != nil {
+			if err := os.MkdirAll(filepath.Dir(sigPath), 0o700); err != nil {
+				return err
+			}
+			if err := os.WriteFile(sigPath, sig, 0o600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := WriteFile(opts.Current, out); err != nil {
+		return err
+	}
+
+	record.Ciphertext = ciphertextDigest(out, nil)
+	if err := ctx.saveEncryptRecord(secret.Path, record); err != nil {
+		return err
+	}
+
+	// decrypted secrets without local changes follow the merge
+	if !ctx.Config.Filter {
+		decryptedPath := filepath.Join(ctx.SecretStorePath, secret.Path)
+		if plaintext, err := os.ReadFile(decryptedPath); err == nil && bytes.Equal(plaintext, ours) {
+			if err := os.WriteFile(decryptedPath, merged, 0o600); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("merged %q\n", secret.Path)
+	return nil
+}
+
+var mergeLabels = [3]string{"base", "ours", "theirs"}
+
+// mergedRevs returns the commits merged into HEAD, which git merge passes to
+// merge drivers as GITHEAD_<commit> variables. Other commands don't.
+func mergedRevs() []string {
+	var revs []string
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "GITHEAD_") {
+			revs = append(revs, strings.TrimPrefix(name, "GITHEAD_"))
+		}
+	}
+	return revs
+}
+
+// revSignatures returns the signatures of the encrypted file at path, relative
+// to the root directory, in revs which have one.
+func (ctx *Context) revSignatures(path string, revs []string) [][]byte {
+	var sigs [][]byte
+	for _, rev := range revs {
+		sig, err := ctx.git("cat-file", "blob", rev+":./"+filepath.ToSlash(path)+signatureExt)
+		if err == nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// writeUnsigned leaves merged plaintext of the secret which can't be signed as
+// a conflict, to be checked and signed with agec encrypt.
+func (ctx *Context) writeUnsigned(secret Secret, current string, ours, merged []byte, reason string) error {
+	kept, err := ctx.writeMerged(secret, current, ours, merged)
+	if err != nil {
+		return err
+	}
+	if kept {
+		return fmt.Errorf("CONFLICT: %q %s and has local changes, which were kept. Merge them and run `agec encrypt --force %s`", secret.Path, reason, secret.Path)
+	}
+	return fmt.Errorf("CONFLICT: %q %s. Check the merged secret and run `agec encrypt --force %s`", secret.Path, reason, secret.Path)
+}
+
+// mergedSigPath is where the merge of an encrypted file leaves its signature
+// for the merge of the signature file, which git merges after it.
+func (ctx *Context) mergedSigPath(sigFile string) string {
+	return filepath.Join(ctx.RootDir, ".git", "agec", "merged", filepath.FromSlash(sigFile))
+}
+
+// mergeSignatureFile merges the signature of an encrypted file, which is the
+// signature of the merged encrypted file. Without one, the encrypted file was
+// left as a conflict, or couldn't be signed, and so is its signature.
+func (ctx *Context) mergeSignatureFile(path, current string) error {
+	sigPath := ctx.mergedSigPath(path)
+	sig, err := os.ReadFile(sigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		secretPath := strings.TrimSuffix(path, ".age"+signatureExt)
+		return fmt.Errorf("CONFLICT: %q can't be merged, sign the merged secret with `agec encrypt --force %s`", path, secretPath)
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Remove(sigPath); err != nil {
+		return err
+	}
+	return WriteFile(current, sig)
+}
+
+// checkMergeSignature is like checkSecretSignature, for a version of the
+// encrypted file being merged.
+func (ctx *Context) checkMergeSignature(secret Secret, label string, ciphertext []byte, sigs [][]byte) error {
+	err := verifySignatures(ctx.Config, secret, signedFilePayload(ciphertext, nil), sigs)
+	if err == nil {
+		return nil
+	}
+
+	if !ctx.signatureRequired(ctx.Config, secret) || os.Getenv("AGEC_ALLOW_UNSIGNED") != "" {
+		log.Printf("WARNING: %s version of %q: %v, its content may have been replaced by someone other than its writers", label, secret.Path, err)
+		return nil
+	}
+	return fmt.Errorf("refusing to merge %s version of %q: %v. Merge it by hand, or set AGEC_ALLOW_UNSIGNED=1 to ignore", label, secret.Path, err)
+}
+
+// mergeText runs a three-way merge of plaintext with git merge-file, and
+// reports whether the result has conflicts. The plaintext is written to a
+// temporary directory next to the secret store, not to a shared one.
+func (ctx *Context) mergeText(base, ours, theirs []byte) ([]byte, bool, error) {
+	parent := filepath.Join(ctx.RootDir, ".git", "agec")
+	if err := os.MkdirAll(parent, 0o700); err != nil {
+		return nil, false, err
+	}
+	dir, err := os.MkdirTemp(parent, "merge-")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	var files [3]string
+	for i, plaintext := range [][]byte{base, ours, theirs} {
+		files[i] = filepath.Join(dir, mergeLabels[i])
+		if err := os.WriteFile(files[i], plaintext, 0o600); err != nil {
+			return nil, false, err
+		}
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("git", "merge-file", "-p",
+		"-L", mergeLabels[1], "-L", mergeLabels[0], "-L", mergeLabels[2],
+		files[1], files[0], files[2])
+	cmd.Stderr = stderr
+
+	// the exit status is the number of conflicts, or negative on errors
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+		return out, true, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("git merge-file: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, false, nil
+}
+
+// writeConflict writes the conflicted plaintext of the secret where it's
+// decrypted and marks the secret as conflicted, so that it can't be encrypted
+// or committed before the conflicts are resolved.
+func (ctx *Context) writeConflict(secret Secret, current string, ours, conflicted []byte) error {
+	kept, err := ctx.writeMerged(secret, current, ours, conflicted)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ctx.Config.Filter:
+		return fmt.Errorf("CONFLICT: %q has conflicts, resolve them and stage it", secret.Path)
+	case kept:
+		return fmt.Errorf("CONFLICT: %q has conflicts and local changes, which were kept. Resolve the conflicts in them and run `agec encrypt --force %s`", secret.Path, secret.Path)
+	default:
+		return fmt.Errorf("CONFLICT: %q has conflicts, resolve them and run `agec encrypt --force %s`", secret.Path, secret.Path)
+	}
+}
+
+// writeMerged writes merged plaintext of the secret, which the merge driver
+// can't encrypt, where it's decrypted and marks the secret as conflicted.
+// Filtered secrets are decrypted in the working tree, so it's written to the
+// current file, which the filter encrypts before it's stored. Decrypted
+// secrets with local changes are kept as they are, which is reported.
+func (ctx *Context) writeMerged(secret Secret, current string, ours, merged []byte) (bool, error) {
+	if err := ctx.setConflict(secret.Path, true); err != nil {
+		return false, err
+	}
+
+	if ctx.Config.Filter {
+		return false, WriteFile(current, merged)
+	}
+
+	decryptedPath := filepath.Join(ctx.SecretStorePath, secret.Path)
+	plaintext, err := os.ReadFile(decryptedPath)
+	if err == nil && !bytes.Equal(plaintext, ours) {
+		return true, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(decryptedPath), 0o700); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(decryptedPath, merged, 0o600); err != nil {
+		return false, err
+	}
+
+	linkPath := filepath.Join(ctx.RootDir, secret.Path)
+	link, err := filepath.Rel(filepath.Dir(linkPath), decryptedPath)
+	if err != nil {
+		return false, err
+	}
+	if err := os.Symlink(link, linkPath); err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+func (ctx *Context) conflictsPath() string {
+	return filepath.Join(ctx.RootDir, ".git", "agec", "conflicts")
+}
+
+// readConflicts returns the paths of secrets with unresolved conflicts of the
+// merge driver.
+func (ctx *Context) readConflicts() ([]string, error) {
+	b, err := os.ReadFile(ctx.conflictsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// setConflict marks or unmarks the secret at path as conflicted.
+func (ctx *Context) setConflict(path string, conflicted bool) error {
+	paths, err := ctx.readConflicts()
+	if err != nil {
+		return err
+	}
+
+	path = filepath.ToSlash(path)
+	if lo.Contains(paths, path) == conflicted {
+		return nil
+	}
+	if conflicted {
+		paths = append(paths, path)
+	} else {
+		paths = lo.Filter(paths, func(p string, _ int) bool { return p != path })
+	}
+
+	if len(paths) == 0 {
+		return os.Remove(ctx.conflictsPath())
+	}
+	if err := os.MkdirAll(filepath.Dir(ctx.conflictsPath()), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(ctx.conflictsPath(), []byte(strings.Join(paths, "\n")+"\n"), 0o600)
+}
+
+// checkResolved returns an error if the secret at path is conflicted and
+// plaintext still has conflict markers.
+func (ctx *Context) checkResolved(path string, plaintext []byte) error {
+	paths, err := ctx.readConflicts()
+	if err != nil {
+		return err
+	}
+	if lo.Contains(paths, filepath.ToSlash(path)) && hasConflictMarkers(plaintext) {
+		return fmt.Errorf("%q has unresolved conflicts of a merge, resolve them first", path)
+	}
+	return nil
+}
+
+func hasConflictMarkers(b []byte) bool {
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "<<<<<<< ") || strings.HasPrefix(line, ">>>>>>> ") {
+			return true
+		}
+	}
+	return false
+}
+
+func newMergeDriverCmd(ctx *Context) *cobra.Command {
+	opts := &mergeDriverOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "merge-driver <base> <current> <other> <path>",
+		Short: "Merge the plaintext of secrets for git merge",
+		Long: `Merge the decrypted versions of a secret, as the merge driver set up by
+'agec git setup'. The result is encrypted to the owners of the secret.
+
+If the merge has conflicts, the conflicted plaintext is written where the
+secret is decrypted, and the encrypted file is left as ours. The secret can't
+be encrypted or committed until the conflicts are resolved, or discarded with
+'agec decrypt --force'. Threshold secrets can't be merged.
+
+Both versions are verified with the signatures of the merged commits, which
+only git merge tells. The result is signed with your SSH key, and merging the
+signature file takes that signature. Secrets which have writers are left as a
+conflict with the merged plaintext, to be checked and signed with
+'agec encrypt --force', as are secrets which must be signed if none of your
+SSH keys can.`,
+		Example: `  # in .gitattributes, with 'agec git setup'
+  *.age merge=agec
+  *.age.sig merge=agec
+
+  # in .git/config
+  [merge "agec"]
+      driver = agec merge-driver %O %A %B %P`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(4),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.Base, opts.Current, opts.Other, opts.Path = args[0], args[1], args[2], args[3]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMergeDriver(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Specify identity file to decrypt file")
+
+	return cmd
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// Policy restricts what can be configured in the root config.
+type Policy struct {
+	Keys   KeyPolicy    `yaml:"keys,omitempty"`
+	Access []AccessRule `yaml:"access,omitempty"`
+}
+
+// AccessRule restricts the readers of secrets whose path matches Pattern.
+// Readers are the users of the secret and members of its groups, including
+// nested groups.
+type AccessRule struct {
+	Pattern string `yaml:"pattern"`
+
+	// DenyUsers, DenyGroups must not be readers.
+	DenyUsers  []string `yaml:"deny_users,omitempty"`
+	DenyGroups []string `yaml:"deny_groups,omitempty"`
+
+	// RequireUsers, RequireGroups must be readers.
+	RequireUsers  []string `yaml:"require_users,omitempty"`
+	RequireGroups []string `yaml:"require_groups,omitempty"`
+
+	// MaxReaders is the maximum number of readers, unlimited if zero.
+	MaxReaders int `yaml:"max_readers,omitempty"`
+}
+
+// KeyPolicy restricts public keys of users.
+type KeyPolicy struct {
+	// AllowedTypes are the allowed key types, "ssh-ed25519", "ssh-rsa" or
+	// "x25519". All types are allowed if empty.
+	AllowedTypes []string `yaml:"allowed_types,omitempty"`
+
+	// MinRSABits is the minimum size of ssh-rsa keys.
+	MinRSABits int `yaml:"min_rsa_bits,omitempty"`
+
+	// NoSharedKeys forbids the same public key for multiple users.
+	NoSharedKeys bool `yaml:"no_shared_keys,omitempty"`
+}
+
+const keyTypeX25519 = "x25519"
+
+// KeyPolicyViolations returns the reasons why key violates the key policy.
+func (cfg *Config) KeyPolicyViolations(key string) []string {
+	p := cfg.Policy.Keys
+	var violations []string
+
+	if strings.HasPrefix(key, "age1") {
+		if len(p.AllowedTypes) != 0 && !lo.Contains(p.AllowedTypes, keyTypeX25519) {
+			violations = append(violations, fmt.Sprintf("key type %q is not allowed", keyTypeX25519))
+		}
+	} else {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		if len(p.AllowedTypes) != 0 && !lo.Contains(p.AllowedTypes, pk.Type()) {
+			violations = append(violations, fmt.Sprintf("key type %q is not allowed", pk.Type()))
+		}
+
+		if cpk, ok := pk.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+				violations = append(violations, fmt.Sprintf("RSA key size %d is smaller than %d bits", rsaKey.N.BitLen(), p.MinRSABits))
+			}
+		}
+	}
+
+	if p.NoSharedKeys {
+		if owners := cfg.KeyOwners(key); len(owners) > 1 {
+			violations = append(violations, fmt.Sprintf("key is shared by users %s", strings.Join(owners, ", ")))
+		}
+	}
+
+	return violations
+}
+
+// CheckKeyPolicy returns an error if any of keys violates the key policy.
+func (cfg *Config) CheckKeyPolicy(keys []string) error {
+	for _, key := range keys {
+		if violations := cfg.KeyPolicyViolations(key); len(violations) != 0 {
+			return fmt.Errorf("recipient %q violates key policy: %s", key, strings.Join(violations, ", "))
+		}
+	}
+	return nil
+}
+
+// KeyOwners returns the users which have a key with the same fingerprint as
+// key.
+func (cfg *Config) KeyOwners(key string) []string {
+	fingerprint, err := keyFingerprint(key)
+	if err != nil {
+		return nil
+	}
+
+	var owners []string
+	for _, u := range cfg.Users {
+		for _, rec := range u.Keys() {
+			if f, err := keyFingerprint(rec); err == nil && f == fingerprint {
+				owners = append(owners, u.Name)
+				break
+			}
+		}
+	}
+	return owners
+}
+
+// Readers returns the users who can read the secret.
+func (cfg *Config) Readers(secret Secret) ([]string, error) {
+	readers := append([]string{}, secret.Users...)
+	for _, group := range secret.Groups {
+		members, err := cfg.GroupMembers(group)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, members...)
+	}
+	return lo.Uniq(readers), nil
+}
+
+// AccessPolicyViolations returns the reasons why the owners of secret violate
+// the access policy.
+func (cfg *Config) AccessPolicyViolations(secret Secret) ([]string, error) {
+	readers, err := cfg.Readers(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []string
+	for _, rule := range cfg.Policy.Access {
+		ok, err := matchPattern(rule.Pattern, filepath.ToSlash(secret.Path))
+		if err != nil {
+			return nil, fmt.Errorf("malformed pattern %q: %v", rule.Pattern, err)
+		}
+		if !ok {
+			continue
+		}
+
+		for _, user := range rule.DenyUsers {
+			if lo.Contains(readers, user) {
+				violations = append(violations, fmt.Sprintf("user %q must not be a reader by %q", user, rule.Pattern))
+			}
+		}
+
+		for _, group := range rule.DenyGroups {
+			members, err := cfg.GroupMembers(group)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range lo.Intersect(readers, members) {
+				violations = append(violations, fmt.Sprintf("user %q of group %q must not be a reader by %q", user, group, rule.Pattern))
+			}
+		}
+
+		for _, user := range rule.RequireUsers {
+			if !lo.Contains(readers, user) {
+				violations = append(violations, fmt.Sprintf("user %q must be a reader by %q", user, rule.Pattern))
+			}
+		}
+
+		for _, group := range rule.RequireGroups {
+			members, err := cfg.GroupMembers(group)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range members {
+				if !lo.Contains(readers, user) {
+					violations = append(violations, fmt.Sprintf("user %q of group %q must be a reader by %q", user, group, rule.Pattern))
+				}
+			}
+		}
+
+		if rule.MaxReaders != 0 && len(readers) > rule.MaxReaders {
+			violations = append(violations, fmt.Sprintf("%d readers exceed the limit %d of %q", len(readers), rule.MaxReaders, rule.Pattern))
+		}
+	}
+
+	return violations, nil
+}
+
+// CheckAccessPolicy returns an error if the owners of secret violate the access
+// policy.
+func (cfg *Config) CheckAccessPolicy(secret Secret) error {
+	violations, err := cfg.AccessPolicyViolations(secret)
+	if err != nil {
+		return err
+	}
+
+	if len(violations) != 0 {
+		return fmt.Errorf("secret %q violates access policy: %s", secret.Path, strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// CheckAccessPolicies checks the access policy for secrets.
+func (cfg *Config) CheckAccessPolicies(secrets []Secret) error {
+	for _, secret := range secrets {
+		if err := cfg.CheckAccessPolicy(secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyAffectedSecrets returns the secrets of after whose readers differ
+// from the readers in before, or which violate the access policy in a way
+// they didn't in before, e.g. as a required group got a new member. Existing
+// violations of other secrets don't block changes of users and groups.
+func policyAffectedSecrets(before, after *Config) []Secret {
+	return lo.Filter(after.Secrets, func(secret Secret, _ int) bool {
+		old, err := before.GetSecret(secret.Path)
+		if err != nil {
+			return true
+		}
+
+		oldReaders, _ := before.Readers(old)
+		readers, _ := after.Readers(secret)
+		sort.Strings(oldReaders)
+		sort.Strings(readers)
+		if strings.Join(oldReaders, "\n") != strings.Join(readers, "\n") {
+			return true
+		}
+
+		oldViolations, _ := before.AccessPolicyViolations(old)
+		violations, _ := after.AccessPolicyViolations(secret)
+		return lo.ContainsBy(violations, func(v string) bool { return !lo.Contains(oldViolations, v) })
+	})
+}
+
+// checkAccessPolicy finds secrets whose owners violate the access policy.
+func checkAccessPolicy(ctx *Context) ([]checkProblem, error) {
+	var problems []checkProblem
+
+	for _, secret := range ctx.Config.Secrets {
+		violations, err := ctx.Config.AccessPolicyViolations(secret)
+		if err != nil {
+			return nil, err
+		}
+		for _, violation := range violations {
+			problems = append(problems, checkProblem{
+				Path:    secret.Path,
+				Message: violation,
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// checkKeyPolicy finds keys of users which violate the key policy.
+func checkKeyPolicy(ctx *Context) ([]checkProblem, error) {
+	var problems []checkProblem
+
+	for _, u := range ctx.Config.Users {
+		for _, key := range u.Keys() {
+			for _, violation := range ctx.Config.KeyPolicyViolations(key) {
+				problems = append(problems, checkProblem{
+					Path:    defaultConfigFilename,
+					Message: fmt.Sprintf("user %q: key %q: %s", u.Name, key, violation),
+				})
+			}
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// recoveryHolder is the holder of the whole key of threshold secrets in the
+// shares, encrypted to the recovery recipients.
+const recoveryHolder = "@recovery"
+
+// RecoveryRecipient is a key every secret is encrypted to in addition to its
+// owners, like an offline recovery key or the deploy key of CI.
+type RecoveryRecipient struct {
+	Key     string `yaml:"key"`
+	Comment string `yaml:"comment,omitempty"`
+
+	// Exclude are patterns of secrets which are not encrypted to the key.
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	// Modes are the modes of secrets other than any which are encrypted to
+	// the key, "threshold" or "all". They must be opted in, as the key alone
+	// decrypts them, with the whole key of threshold secrets and every layer
+	// of secrets which need all of their owners.
+	Modes []string `yaml:"modes,omitempty"`
+}
+
+// RecoveryKeys returns the keys of the recovery recipients of the secret.
+func (cfg *Config) RecoveryKeys(secret Secret) ([]string, error) {
+	var keys []string
+	for _, r := range cfg.RecoveryRecipients {
+		for _, mode := range r.Modes {
+			if mode != secretModeThreshold && mode != secretModeAll {
+				return nil, fmt.Errorf("invalid mode %q of recovery recipient, must be %q or %q", mode, secretModeThreshold, secretModeAll)
+			}
+		}
+		if secret.Mode != secretModeAny && !lo.Contains(r.Modes, secret.Mode) {
+			continue
+		}
+
+		excluded := false
+		for _, pattern := range r.Exclude {
+			ok, err := matchPattern(pattern, filepath.ToSlash(secret.Path))
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %q of recovery recipient: %v", pattern, err)
+			}
+			if ok {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			keys = append(keys, r.Key)
+		}
+	}
+	return keys, nil
+}
+
+// checkRecoveryRecipients finds encrypted files which the recovery recipients
+// can't decrypt.
+func checkRecoveryRecipients(ctx *Context) ([]checkProblem, error) {
+	cfg := ctx.Config
+	var problems []checkProblem
+
+	for _, secret := range cfg.Secrets {
+		recovery, err := cfg.RecoveryKeys(secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(recovery) == 0 {
+			continue
+		}
+
+		encryptedFile := secret.Path + ".age"
+		if !fileExists(filepath.Join(ctx.RootDir, encryptedFile)) {
+			continue
+		}
+
+		if secret.Mode == secretModeThreshold {
+			_, holders, err := readShares(filepath.Join(ctx.RootDir, encryptedFile))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", encryptedFile, err)
+			}
+			if !lo.ContainsBy(holders, func(h shareHolder) bool { return h.User == recoveryHolder }) {
+				problems = append(problems, checkProblem{
+					Path:    encryptedFile,
+					Message: "key is not encrypted to the recovery recipients",
+				})
+			}
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(ctx.RootDir, encryptedFile))
+		if err != nil {
+			return nil, err
+		}
+		stanzas, err := readStanzas(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", encryptedFile, err)
+		}
+
+		// X25519 recipients are anonymous, so only their number can be
+		// compared with the owners of the outermost layer
+		owners := outermostOwners(cfg, secret)
+		var x25519 []string
+		for _, key := range recovery {
+			tag, err := sshKeyTag(key)
+			if err != nil {
+				return nil, err
+			}
+			if tag == "" {
+				x25519 = append(x25519, key)
+				continue
+			}
+			if !stanzasHaveTag(stanzas, tag) {
+				problems = append(problems, checkProblem{
+					Path:    encryptedFile,
+					Message: fmt.Sprintf("not encrypted to recovery recipient %q", key),
+				})
+			}
+		}
+
+		if len(x25519) != 0 {
+			expected := lo.Count(lo.Map(lo.Uniq(append(owners, x25519...)), func(key string, _ int) bool {
+				return !strings.HasPrefix(key, "ssh-")
+			}), true)
+			found := lo.Count(lo.Map(stanzas, func(s stanza, _ int) string { return s.Type }), "X25519")
+			if found < expected {
+				problems = append(problems, checkProblem{
+					Path:    encryptedFile,
+					Message: fmt.Sprintf("encrypted to %d X25519 recipients, but %d are expected with the recovery recipients", found, expected),
+				})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// outermostOwners returns the keys of the owners the outermost layer of the
+// secret is encrypted to.
+func outermostOwners(cfg *Config, secret Secret) []string {
+	var keys []string
+	switch {
+	case secret.Mode != secretModeAll:
+		keys, _ = cfg.RecipientKeys(secret.Users, secret.Groups)
+	case len(secret.Groups) != 0:
+		keys, _ = cfg.RecipientKeys(nil, secret.Groups[:1])
+	case len(secret.Users) != 0:
+		keys, _ = cfg.RecipientKeys(secret.Users[:1], nil)
+	}
+	return keys
+}
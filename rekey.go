@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// Clone returns a deep copy of the config.
+func (cfg *Config) Clone() (*Config, error) {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := &Config{}
+	if err := yaml.Unmarshal(b, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// recipientSet returns the sorted keys of the owners and recovery recipients
+// of a secret, or nil if they can't be resolved.
+func (cfg *Config) recipientSet(secret Secret) []string {
+	keys, err := cfg.RecipientKeys(secret.Users, secret.Groups)
+	if err != nil {
+		return nil
+	}
+	recovery, err := cfg.RecoveryKeys(secret)
+	if err != nil {
+		return nil
+	}
+	keys = lo.Uniq(append(keys, recovery...))
+	sort.Strings(keys)
+	return keys
+}
+
+// affectedSecrets returns the secrets of after whose recipients differ from
+// the recipients in before.
+func affectedSecrets(before, after *Config) []Secret {
+	return lo.Filter(after.Secrets, func(secret Secret, _ int) bool {
+		old, err := before.GetSecret(secret.Path)
+		if err != nil {
+			return true
+		}
+		return strings.Join(before.recipientSet(old), "\n") != strings.Join(after.recipientSet(secret), "\n")
+	})
+}
+
+// reencryptSecrets encrypts secrets again with their current owners. Secrets
+// which are not decrypted in the working tree are skipped with a warning.
+func reencryptSecrets(ctx *Context, secrets []Secret) error {
+	for _, secret := range secrets {
+		path := filepath.Join(ctx.RootDir, secret.Path)
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("skipping %q, decrypt it first to re-encrypt: %v", secret.Path, err)
+			continue
+		}
+
+		f, err := sanitizeEncryptArg(ctx, path, ctx.WorkingDir)
+		if err != nil {
+			return err
+		}
+
+		err = runEncrypt(&encryptOpt{
+			FileArg:      f,
+			Force:        true,
+			IdentityFile: os.Getenv("AGEC_IDENTITY"),
+			// the owners were changed on purpose, even if it's the caller
+			AllowLockout: true,
+			ctx:          ctx,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt %q: %v", secret.Path, err)
+		}
+	}
+	return nil
+}
+
+// printAffectedSecrets prints secrets which need to be encrypted again.
+func printAffectedSecrets(secrets []Secret) {
+	if len(secrets) == 0 {
+		return
+	}
+
+	fmt.Println("secrets to re-encrypt:")
+	for _, secret := range secrets {
+		fmt.Printf("  %s\n", secret.Path)
+	}
+}
@@ -57,16 +57,32 @@ func newRootCmd(ctx *Context, out io.Writer, args []string) (*cobra.Command, err
 
 		newEncryptCmd(ctx),
 		newDecryptCmd(ctx),
+		newShareCmd(ctx),
+		newTextconvCmd(ctx),
+		newMergeDriverCmd(ctx),
+		newMergeConfigCmd(ctx),
 
 		newUserAddCmd(ctx),
 		newUserModCmd(ctx),
 		newUserDelCmd(ctx),
+		newUsersCmd(ctx),
 
 		newGroupAddCmd(ctx),
 		newGroupModCmd(ctx),
 		newGroupDelCmd(ctx),
 
 		newChownCmd(ctx),
+		newApplyCmd(ctx),
+
+		newExposureCmd(ctx),
+		newCheckCmd(ctx),
+
+		newKeyCmd(ctx),
+		newConfigCmd(ctx),
+		newRootUserCmd(ctx),
+		newHookCmd(ctx),
+		newGitCmd(ctx),
+		newFilterCmd(ctx),
 
 		newGroupsCmd(ctx),
 	)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+type rootRotateOpt struct {
+	KeyFile    string
+	Passphrase bool
+
+	ctx *Context
+}
+
+func runRootRotate(opts *rootRotateOpt) error {
+	ctx := opts.ctx
+
+	if _, err := ctx.Config.GetUser(rootUser); err != nil {
+		return err
+	}
+
+	k, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	after, err := ctx.Config.Clone()
+	if err != nil {
+		return err
+	}
+	root, _ := after.GetUser(rootUser)
+	root.Recipients = newRecipients([]string{k.Recipient().String()})
+	after.SaveUser(root)
+
+	affected := affectedSecrets(ctx.Config, after)
+
+	// secrets left encrypted to the old key would need it to be decrypted
+	var missing []string
+	for _, secret := range affected {
+		if !fileExists(filepath.Join(ctx.RootDir, secret.Path)) {
+			missing = append(missing, secret.Path)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("secrets to re-encrypt are not decrypted, decrypt them first: %s", strings.Join(missing, ", "))
+	}
+
+	// re-encrypted secrets are reported on stdout, mixed with the key
+	if len(affected) != 0 && opts.KeyFile == "" {
+		return fmt.Errorf("%d secrets are re-encrypted, pass --key-file to write the new key to a file", len(affected))
+	}
+
+	// the new key is written before anything is encrypted to it
+	if err := writeRootKey(k, opts.KeyFile, opts.Passphrase); err != nil {
+		return err
+	}
+
+	ctx.Config = after
+	if err := ctx.WriteConfigFile(); err != nil {
+		return err
+	}
+
+	printAffectedSecrets(affected)
+	return reencryptSecrets(ctx, affected)
+}
+
+func newRootRotateCmd(ctx *Context) *cobra.Command {
+	opts := &rootRotateOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the key of the root user, and re-encrypt its secrets",
+		Long: `Generate a new key for the root user, replace the old one in the config, and
+re-encrypt the secrets the root user can read. The secrets must be decrypted
+first. The key is written to stdout only if no secrets are re-encrypted, which
+are reported there too.`,
+		Example: `  # write the new key to a file
+  agec root rotate --key-file root.key
+
+  # protect the new key with a passphrase
+  agec root rotate --key-file root.key.age --passphrase`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRootRotate(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.KeyFile, "key-file", "o", "", "Write the new key to the file instead of stdout, needed if secrets are re-encrypted")
+	f.BoolVarP(&opts.Passphrase, "passphrase", "p", false, "Encrypt the new key to a passphrase, read from AGEC_PASSPHRASE or the terminal")
+
+	return cmd
+}
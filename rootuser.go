@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const rootUser = "root"
+
+func newRootUserCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "root",
+		Short:         "Manage the key of the root user",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newRootRotateCmd(ctx),
+	)
+
+	return cmd
+}
+
+// writeRootKey writes the generated root key to keyFile, or to stdout if it's
+// empty. With passphrase, the key is encrypted to a passphrase, which can be
+// decrypted by agec or `age -d`.
+func writeRootKey(k *age.X25519Identity, keyFile string, passphrase bool) error {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "# created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(out, "# public key: %s\n", k.Recipient())
+	fmt.Fprintf(out, "%s\n", k)
+
+	if passphrase {
+		pass, err := readPassphrase(true)
+		if err != nil {
+			return err
+		}
+
+		b, err := encryptToPassphrase(out.Bytes(), pass)
+		if err != nil {
+			return err
+		}
+		out = bytes.NewBuffer(b)
+	}
+
+	if keyFile == "" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(out.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote key of user:root to %q\n", keyFile)
+	return nil
+}
+
+func encryptToPassphrase(plaintext []byte, pass string) ([]byte, error) {
+	r, err := age.NewScryptRecipient(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	aw := armor.NewWriter(out)
+	w, err := age.Encrypt(aw, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// parseEncryptedIdentities reads identities from a file encrypted to a
+// passphrase, like the root key written with --passphrase.
+func parseEncryptedIdentities(name string, r io.Reader) ([]age.Identity, error) {
+	pass, err := readPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := age.NewScryptIdentity(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+
+	var in io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(b, []byte(armor.Header)) {
+		in = armor.NewReader(in)
+	}
+
+	dr, err := age.Decrypt(in, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %q: %v", name, err)
+	}
+
+	ids, err := age.ParseIdentities(dr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	return ids, nil
+}
+
+// readPassphrase reads a passphrase from AGEC_PASSPHRASE, or prompts for it
+// on the terminal.
+func readPassphrase(confirm bool) (string, error) {
+	if pass := os.Getenv("AGEC_PASSPHRASE"); pass != "" {
+		return pass, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("can't prompt for a passphrase without a terminal, set AGEC_PASSPHRASE")
+	}
+
+	fmt.Fprint(os.Stderr, "Enter passphrase: ")
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(pass) == 0 {
+		return "", errors.New("passphrase can't be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(pass, again) {
+			return "", errors.New("passphrases didn't match")
+		}
+	}
+	return string(pass), nil
+}
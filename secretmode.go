@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/samber/lo"
+)
+
+const (
+	// sharesExt is the extension of the encrypted shares of threshold
+	// secrets, stored next to the encrypted file.
+	sharesExt = ".shares"
+
+	sharesHeader = "agec-shares/v1"
+	shareHeader  = "agec-share/v1"
+)
+
+// CheckMode returns an error if the mode of the secret is invalid for its
+// owners.
+func (cfg *Config) CheckMode(secret Secret) error {
+	switch secret.Mode {
+	case secretModeAny, secretModeAll:
+		return nil
+	case secretModeThreshold:
+		readers, err := cfg.Readers(secret)
+		if err != nil {
+			return err
+		}
+		if secret.Threshold < 1 || secret.Threshold > len(readers) {
+			return fmt.Errorf("threshold %d of %q must be between 1 and the number of readers %d", secret.Threshold, secret.Path, len(readers))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q of secret %q", secret.Mode, secret.Path)
+	}
+}
+
+// checkDowngrade returns an error if encrypting the secret would weaken its
+// existing encrypted file, by lowering the threshold of its shares or by
+// dropping the layers of the all mode. The layers are only found if
+// identities can decrypt the outer one.
+func checkDowngrade(secret Secret, encryptedFile string, identities []age.Identity) error {
+	if threshold, _, err := readShares(encryptedFile); err == nil {
+		if secret.Mode != secretModeThreshold || secret.Threshold < threshold {
+			return fmt.Errorf("%q needs shares of %d readers, encrypting it for %s would weaken it. Pass --allow-downgrade if that's intended", encryptedFile, threshold, modeDescription(secret))
+		}
+		return nil
+	}
+
+	if secret.Mode == secretModeAll || len(identities) == 0 {
+		return nil
+	}
+
+	ciphertext, err := os.ReadFile(encryptedFile)
+	if err != nil {
+		return nil
+	}
+	out, err := decryptBytes(ciphertext, identities...)
+	if err == nil && bytes.HasPrefix(out, []byte(ageIntro+"\n")) {
+		return fmt.Errorf("%q needs a key of all of its owners, encrypting it for %s would weaken it. Pass --allow-downgrade if that's intended", encryptedFile, modeDescription(secret))
+	}
+	return nil
+}
+
+// modeDescription describes who can decrypt the secret by its mode.
+func modeDescription(secret Secret) string {
+	switch secret.Mode {
+	case secretModeAll:
+		return "all of its owners"
+	case secretModeThreshold:
+		return fmt.Sprintf("%d of its readers", secret.Threshold)
+	default:
+		return "any of its owners"
+	}
+}
+
+// encryptSecret encrypts the content of the file to recipients. For
+// threshold secrets, it also returns the encrypted shares.
+func encryptSecret(path string, recipients *SecretRecipients) ([]byte, []byte, error) {
+	plaintext, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encryptPlaintext(plaintext, recipients)
+}
+
+// encryptPlaintext is like encryptSecret, but encrypts plaintext.
+func encryptPlaintext(plaintext []byte, recipients *SecretRecipients) ([]byte, []byte, error) {
+	var err error
+	if recipients.Threshold == 0 {
+		out := plaintext
+		for i := len(recipients.Layers) - 1; i >= 0; i-- {
+			out, err = encryptBytes(out, recipients.Layers[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return out, nil, nil
+	}
+
+	// the secret is encrypted to a one-time key, which is split in shares
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := encryptBytes(plaintext, []age.Recipient{identity.Recipient()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts, err := shamirSplit([]byte(identity.String()), len(recipients.Holders), recipients.Threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shares := &bytes.Buffer{}
+	fmt.Fprintf(shares, "%s %d\n", sharesHeader, recipients.Threshold)
+	for i, holder := range recipients.Holders {
+		b, err := encryptBytes(parts[i], recipients.Shares[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(shares, "%s %s\n", holder, base64.StdEncoding.EncodeToString(b))
+	}
+
+	// recovery recipients get the whole key, not a share
+	if len(recipients.Recovery) != 0 {
+		b, err := encryptBytes([]byte(identity.String()), recipients.Recovery)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(shares, "%s %s\n", recoveryHolder, base64.StdEncoding.EncodeToString(b))
+	}
+	return out, shares.Bytes(), nil
+}
+
+func encryptBytes(plaintext []byte, recs []age.Recipient) ([]byte, error) {
+	out := &bytes.Buffer{}
+	agew, err := age.Encrypt(out, recs...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := agew.Write(plaintext); err != nil {
+		return nil, err
+	}
+
+	if err := agew.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func decryptBytes(ciphertext []byte, identities ...age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// writeShares writes the encrypted shares of a threshold secret, or removes
+// stale ones if shares is nil.
+func writeShares(encryptedFile string, shares []byte) error {
+	if shares == nil {
+		err := os.Remove(encryptedFile + sharesExt)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return WriteFile(encryptedFile+sharesExt, shares)
+}
+
+// shareHolder is a reader of a threshold secret, and the share encrypted to
+// them.
+type shareHolder struct {
+	User  string
+	Share []byte
+}
+
+func readShares(encryptedFile string) (int, []shareHolder, error) {
+	b, err := os.ReadFile(encryptedFile + sharesExt)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read shares: %v", err)
+	}
+	return parseShares(encryptedFile, b)
+}
+
+// parseShares is like readShares, for shares read elsewhere, e.g. from git.
+func parseShares(encryptedFile string, b []byte) (int, []shareHolder, error) {
+	var err error
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, 1<<20)
+
+	var threshold int
+	var holders []shareHolder
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if n == 1 {
+			if len(fields) != 2 || fields[0] != sharesHeader {
+				return 0, nil, fmt.Errorf("malformed shares of %q", encryptedFile)
+			}
+			threshold, err = strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, nil, fmt.Errorf("malformed shares of %q: %v", encryptedFile, err)
+			}
+			continue
+		}
+
+		if len(fields) != 2 {
+			return 0, nil, fmt.Errorf("malformed shares of %q at line %d", encryptedFile, n)
+		}
+		share, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return 0, nil, fmt.Errorf("malformed shares of %q at line %d: %v", encryptedFile, n, err)
+		}
+		holders = append(holders, shareHolder{User: fields[0], Share: share})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	return threshold, holders, nil
+}
+
+// fileHeaders returns the stanzas of each age header of an encrypted file: its
+// own, the ones of its shares, and the ones of inner layers of all mode
+// secrets, which are only found if identities decrypt the layers around them.
+func fileHeaders(encryptedFile string, ciphertext, shares []byte, identities []age.Identity) ([][]stanza, error) {
+	stanzas, err := readStanzas(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	headers := [][]stanza{stanzas}
+
+	if shares != nil {
+		_, holders, err := parseShares(encryptedFile, shares)
+		if err != nil {
+			return nil, err
+		}
+		for _, holder := range holders {
+			stanzas, err := readStanzas(bytes.NewReader(holder.Share))
+			if err != nil {
+				return nil, fmt.Errorf("malformed share of %q in %q: %v", holder.User, encryptedFile, err)
+			}
+			headers = append(headers, stanzas)
+		}
+	}
+
+	layer := ciphertext
+	for len(identities) != 0 {
+		out, err := decryptBytes(layer, identities...)
+		if err != nil || !bytes.HasPrefix(out, []byte(ageIntro+"\n")) {
+			break
+		}
+		stanzas, err := readStanzas(bytes.NewReader(out))
+		if err != nil {
+			break
+		}
+		headers = append(headers, stanzas)
+		layer = out
+	}
+	return headers, nil
+}
+
+// headersHaveTag reports whether any of headers has a stanza tagged with tag.
+func headersHaveTag(headers [][]stanza, tag string) bool {
+	return lo.ContainsBy(headers, func(stanzas []stanza) bool {
+		return stanzasHaveTag(stanzas, tag)
+	})
+}
+
+// decryptShares returns the shares which identities can decrypt, by user.
+func decryptShares(holders []shareHolder, identities []age.Identity) map[string][]byte {
+	shares := map[string][]byte{}
+	for _, holder := range holders {
+		share, err := decryptBytes(holder.Share, identities...)
+		if err == nil {
+			shares[holder.User] = share
+		}
+	}
+	return shares
+}
+
+// formatShare formats a decrypted share to be handed over to whoever decrypts
+// the secret.
+func formatShare(path, user string, share []byte) string {
+	return fmt.Sprintf("%s %s %s %s", shareHeader, path, user, base64.StdEncoding.EncodeToString(share))
+}
+
+// readShareFile reads shares handed over by other readers of the secret.
+func readShareFile(name string, path string) (map[string][]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := map[string][]byte{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 || fields[0] != shareHeader {
+			return nil, fmt.Errorf("malformed share file %q", name)
+		}
+		if fields[1] != path {
+			return nil, fmt.Errorf("share file %q is for %q, not %q", name, fields[1], path)
+		}
+		share, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed share file %q: %v", name, err)
+		}
+		shares[fields[2]] = share
+	}
+	return shares, nil
+}
+
+// decryptSecret decrypts the encrypted file of the secret according to its
+// mode. Threshold secrets are decrypted with the shares identities can
+// decrypt, and the shares handed over in shareFiles.
+func decryptSecret(secret Secret, encryptedFile string, ciphertext []byte, identities []age.Identity, shareFiles []string) ([]byte, error) {
+	switch secret.Mode {
+	case secretModeAll:
+		layers := append(
+			lo.Map(secret.Groups, func(g string, _ int) string { return fmt.Sprintf("group %q", g) }),
+			lo.Map(secret.Users, func(u string, _ int) string { return fmt.Sprintf("user %q", u) })...,
+		)
+
+		out := ciphertext
+		for i, layer := range layers {
+			var err error
+			out, err = decryptBytes(out, identities...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt layer %d of %d, which needs a key of %s: %v", i+1, len(layers), layer, err)
+			}
+		}
+		return out, nil
+
+	case secretModeThreshold:
+		threshold, holders, err := readShares(encryptedFile)
+		if err != nil {
+			return nil, err
+		}
+
+		shares := decryptShares(holders, identities)
+		for _, name := range shareFiles {
+			handed, err := readShareFile(name, secret.Path)
+			if err != nil {
+				return nil, err
+			}
+			for user, share := range handed {
+				shares[user] = share
+			}
+		}
+
+		// the recovery holder has the whole key
+		if key, ok := shares[recoveryHolder]; ok {
+			identity, err := age.ParseX25519Identity(string(key))
+			if err != nil {
+				return nil, errors.New("failed to read the recovery key of the shares")
+			}
+			return decryptBytes(ciphertext, identity)
+		}
+
+		if len(shares) < threshold {
+			missing := lo.Filter(lo.Map(holders, func(h shareHolder, _ int) string { return h.User }), func(u string, _ int) bool {
+				_, ok := shares[u]
+				return !ok && u != recoveryHolder
+			})
+			return nil, fmt.Errorf("needs shares of %d readers, found %d. Ask %s to hand over theirs with `agec share %s.age`, and pass them with --share", threshold, len(shares), strings.Join(missing, ", "), secret.Path)
+		}
+
+		key, err := shamirCombine(lo.Values(shares))
+		if err != nil {
+			return nil, err
+		}
+
+		identity, err := age.ParseX25519Identity(string(key))
+		if err != nil {
+			return nil, errors.New("failed to recover the key from shares, some of them may be corrupted")
+		}
+		return decryptBytes(ciphertext, identity)
+
+	default:
+		return decryptBytes(ciphertext, identities...)
+	}
+}
+
+// localIdentities loads the identities of the caller, or nil if there aren't
+// any.
+func localIdentities(identityFile string) []age.Identity {
+	identities, err := loadIdentities(identityFile)
+	if err != nil {
+		return nil
+	}
+	return identities
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// signatureExt is the extension of detached signatures of encrypted files.
+const signatureExt = ".sig"
+
+// fileSigNamespace binds the signature to the path of the secret, so a signed
+// ciphertext can't be moved to another secret.
+func fileSigNamespace(path string) string {
+	return "agec-file:" + filepath.ToSlash(path)
+}
+
+// AllowedWriters returns the users who may sign the encrypted file of the
+// secret, and whether a writers rule matches it. Without a matching rule, any
+// reader may write the secret.
+func (cfg *Config) AllowedWriters(secret Secret) ([]string, bool, error) {
+	rule, ok, err := matchRule(cfg.Writers, secret.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		readers, err := cfg.Readers(secret)
+		return readers, false, err
+	}
+
+	writers := append([]string{}, rule.Users...)
+	for _, group := range rule.Groups {
+		members, err := cfg.GroupMembers(group)
+		if err != nil {
+			return nil, false, err
+		}
+		writers = append(writers, members...)
+	}
+	return lo.Uniq(writers), true, nil
+}
+
+// signatureRequired reports whether the encrypted file of the secret must be
+// signed, which is once any writers rule is set, or once the file has been
+// signed, so that the signature can't be dropped along with a replaced file.
+func (ctx *Context) signatureRequired(cfg *Config, secret Secret) bool {
+	if len(cfg.Writers) != 0 {
+		return true
+	}
+
+	sigFile := filepath.ToSlash(secret.Path) + ".age" + signatureExt
+	if fileExists(filepath.Join(ctx.RootDir, sigFile)) {
+		return true
+	}
+	out, err := ctx.git("log", "-1", "--format=%H", "--", sigFile)
+	return err == nil && len(bytes.TrimSpace(out)) != 0
+}
+
+// signingKeys returns the SSH keys of users which can make signatures.
+func (cfg *Config) signingKeys(users []string) []string {
+	var keys []string
+	for _, name := range users {
+		u, err := cfg.GetUser(name)
+		if err != nil {
+			continue
+		}
+		for _, key := range u.Keys() {
+			if strings.HasPrefix(key, "ssh-") && !cfg.IsRevoked(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// signedFilePayload returns what the signature of an encrypted file covers,
+// the ciphertext, and for threshold secrets the digests of the ciphertext and
+// of the shares, which would decrypt it otherwise.
+func signedFilePayload(ciphertext, shares []byte) []byte {
+	if shares == nil {
+		return ciphertext
+	}
+	c, s := sha256.Sum256(ciphertext), sha256.Sum256(shares)
+	return []byte(fmt.Sprintf("agec-signed-file/v1\nciphertext %x\nshares %x\n", c, s))
+}
+
+// signSecret signs the ciphertext and shares of the secret with an SSH key of
+// an allowed writer. It returns nil if the caller has no such key, unless the
+// file is required to be signed.
+func signSecret(cfg *Config, secret Secret, ciphertext, shares []byte, identityFile string, required bool) ([]byte, error) {
+	writers, _, err := cfg.AllowedWriters(secret)
+	if err != nil {
+		return nil, err
+	}
+	keys := cfg.signingKeys(writers)
+
+	signers, err := loadSigners(identityFile)
+	if err != nil && required {
+		return nil, err
+	}
+
+	signer, ok := lo.Find(signers, func(s ssh.Signer) bool {
+		return hasKey(keys, s.PublicKey())
+	})
+	if !ok {
+		if required {
+			return nil, fmt.Errorf("none of your ssh keys is an allowed writer of %q", secret.Path)
+		}
+		return nil, nil
+	}
+
+	return sshSign(signer, fileSigNamespace(secret.Path), signedFilePayload(ciphertext, shares))
+}
+
+// writeSignature writes the detached signature of an encrypted file, or
+// removes a stale one if sig is nil.
+func writeSignature(encryptedFile string, sig []byte) error {
+	if sig == nil {
+		err := os.Remove(encryptedFile + signatureExt)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return WriteFile(encryptedFile+signatureExt, sig)
+}
+
+// verifySecret checks the encrypted file of the secret, with its shares, is
+// signed by an allowed writer.
+func verifySecret(cfg *Config, secret Secret, encryptedFile string, ciphertext []byte) error {
+	shares, err := os.ReadFile(encryptedFile + sharesExt)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var sigs [][]byte
+	sig, err := os.ReadFile(encryptedFile + signatureExt)
+	if err == nil {
+		sigs = append(sigs, sig)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return verifySignatures(cfg, secret, signedFilePayload(ciphertext, shares), sigs)
+}
+
+var errFileNotSigned = errors.New("not signed")
+
+// verifySignatures is like verifySecret, but checks the signed payload against
+// signatures read elsewhere. It's signed if any of them verifies.
+func verifySignatures(cfg *Config, secret Secret, payload []byte, sigs [][]byte) error {
+	if len(sigs) == 0 {
+		return errFileNotSigned
+	}
+
+	writers, _, err := cfg.AllowedWriters(secret)
+	if err != nil {
+		return err
+	}
+
+	for _, sig := range sigs {
+		var pub ssh.PublicKey
+		pub, err = sshVerify(sig, fileSigNamespace(secret.Path), payload)
+		if err != nil {
+			err = fmt.Errorf("invalid signature: %v", err)
+			continue
+		}
+
+		if !hasKey(cfg.signingKeys(writers), pub) {
+			err = fmt.Errorf("signed by %s, which is not an allowed writer", ssh.FingerprintSHA256(pub))
+			continue
+		}
+		return nil
+	}
+	return err
+}
+
+// checkSecretSignature verifies the encrypted file of the secret. Files which
+// must be signed are refused unless AGEC_ALLOW_UNSIGNED is set; other files
+// which are unsigned or fail to verify are warned about.
+func (ctx *Context) checkSecretSignature(secret Secret, encryptedFile string, ciphertext []byte) error {
+	err := verifySecret(ctx.Config, secret, encryptedFile, ciphertext)
+	if err == nil {
+		return nil
+	}
+
+	if !ctx.signatureRequired(ctx.Config, secret) || os.Getenv("AGEC_ALLOW_UNSIGNED") != "" {
+		log.Printf("WARNING: %q: %v, its content may have been replaced by someone other than its writers", encryptedFile, err)
+		return nil
+	}
+	return fmt.Errorf("refusing to decrypt %q: %v. Set AGEC_ALLOW_UNSIGNED=1 to ignore", encryptedFile, err)
+}
+
+// checkFileSignatures finds encrypted files which are not signed by their
+// allowed writers. Unsigned files are only reported if they must be signed.
+func checkFileSignatures(ctx *Context) ([]checkProblem, error) {
+	cfg := ctx.Config
+	var problems []checkProblem
+
+	for _, secret := range cfg.Secrets {
+		encryptedFile := filepath.Join(ctx.RootDir, secret.Path+".age")
+		b, err := os.ReadFile(encryptedFile)
+		if err != nil {
+			continue
+		}
+
+		err = verifySecret(cfg, secret, encryptedFile, b)
+		if errors.Is(err, errFileNotSigned) && !ctx.signatureRequired(cfg, secret) {
+			continue
+		}
+		if err != nil {
+			problems = append(problems, checkProblem{Path: secret.Path + ".age", Message: err.Error()})
+		}
+	}
+	return problems, nil
+}
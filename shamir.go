@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8), one polynomial per byte of the
+// secret. A share is the values of the polynomials at x, followed by x.
+
+var gfExp, gfLog [256]byte
+
+func init() {
+	// 3 generates the multiplicative group of GF(2^8) with the AES
+	// polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		x ^= gfMulSlow(x, 2)
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMulSlow(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// shamirSplit splits secret into n shares, any k of which recover it.
+func shamirSplit(secret []byte, n, k int) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", k, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, k)
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			shares[i][j] = y
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from shares. It can't tell whether there
+// are enough shares, which is left to the caller.
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+
+	size := len(shares[0])
+	xs := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, errors.New("malformed share")
+		}
+		x := share[size-1]
+		if x == 0 || xs[x] {
+			return nil, errors.New("malformed or duplicated share")
+		}
+		xs[x] = true
+	}
+
+	secret := make([]byte, size-1)
+	for j := range secret {
+		// Lagrange interpolation at 0
+		var y byte
+		for i, si := range shares {
+			xi := si[size-1]
+			l := byte(1)
+			for m, sm := range shares {
+				if m == i {
+					continue
+				}
+				xm := sm[size-1]
+				l = gfMul(l, gfDiv(xm, xm^xi))
+			}
+			y ^= gfMul(si[j], l)
+		}
+		secret[j] = y
+	}
+	return secret, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+type shareOpt struct {
+	IdentityFile string
+	Identities   []age.Identity
+	FileArg      string
+
+	ctx *Context
+}
+
+func runShare(opts *shareOpt) error {
+	ctx := opts.ctx
+
+	path, err := filepath.Rel(ctx.RootDir, filepath.Join(ctx.WorkingDir, strings.TrimSuffix(opts.FileArg, ".age")))
+	if err != nil {
+		return err
+	}
+
+	secret, err := ctx.Config.GetSecret(path)
+	if err != nil {
+		return fmt.Errorf("%q is not tracked by agec", opts.FileArg)
+	}
+	if secret.Mode != secretModeThreshold {
+		return fmt.Errorf("%q is not a threshold secret", opts.FileArg)
+	}
+
+	_, holders, err := readShares(opts.FileArg)
+	if err != nil {
+		return err
+	}
+
+	shares := decryptShares(holders, opts.Identities)
+	if len(shares) == 0 {
+		return fmt.Errorf("none of your identities holds a share of %q", opts.FileArg)
+	}
+
+	for _, holder := range holders {
+		if share, ok := shares[holder.User]; ok {
+			fmt.Println(formatShare(secret.Path, holder.User, share))
+		}
+	}
+	return nil
+}
+
+func newShareCmd(ctx *Context) *cobra.Command {
+	opts := &shareOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "share",
+		Short: "Print your share of a threshold secret",
+		Long: `Print your decrypted share of a threshold secret, to hand over to whoever
+decrypts it with 'agec decrypt --share'. Anyone who gets enough shares can
+decrypt the secret, so hand them over privately.`,
+		Example: `  # john hands over his share to merry
+  agec share signing.key.age > john.share
+
+  # merry decrypts with her own share and john's
+  agec decrypt signing.key.age --share john.share`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			var err error
+			opts.Identities, err = loadIdentities(opts.IdentityFile)
+			if err != nil {
+				return err
+			}
+
+			opts.FileArg, err = sanitizeDecryptArg(args[0], ctx.WorkingDir)
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runShare(opts)
+		},
+		ValidArgsFunction: EncryptedFileCompletion(ctx),
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Specify identity file to decrypt the share")
+
+	return cmd
+}
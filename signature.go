@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+const configSigNamespace = "agec-config"
+
+var errConfigNotSigned = fmt.Errorf("%s is not signed", defaultConfigFilename)
+
+// signedPayloadHeader is the first line of the signed payload, and names the
+// version of its encoding. Records added later are only written when set, to
+// keep signatures made before they existed valid.
+const signedPayloadHeader = "agec-signed-config/v1"
+
+// signedPayload encodes the part of the config covered by the admin
+// signature, everything which decides who can decrypt secrets. Each fact is a
+// record on its own line, a kind followed by quoted fields. Records of users,
+// groups and secrets are sorted, as their order doesn't matter, while rules
+// keep their order. Comments and devices of keys are not signed.
+func (cfg *Config) signedPayload() []byte {
+	var lines []string
+	sorted := func(block []string) {
+		sort.Strings(block)
+		lines = append(lines, block...)
+	}
+
+	lines = append(lines, signedPayloadHeader, payloadRecord("version", cfg.Version))
+
+	var block []string
+	for _, admin := range cfg.Admins {
+		block = append(block, payloadRecord("admin", admin))
+	}
+	sorted(block)
+
+	block = nil
+	for _, u := range cfg.Users {
+		block = append(block, payloadRecord("user", u.Name))
+		for _, key := range u.Keys() {
+			block = append(block, payloadRecord("user-key", u.Name, payloadKey(key)))
+		}
+	}
+	sorted(block)
+
+	block = nil
+	for _, g := range cfg.Groups {
+		block = append(block, payloadRecord("group", g.Name))
+		for _, member := range g.Members {
+			block = append(block, payloadRecord("group-member", g.Name, member))
+		}
+		for _, nested := range g.Groups {
+			block = append(block, payloadRecord("group-group", g.Name, nested))
+		}
+	}
+	sorted(block)
+
+	block = nil
+	for _, fingerprint := range cfg.RevokedKeys {
+		block = append(block, payloadRecord("revoked-key", fingerprint))
+	}
+	sorted(block)
+
+	keys := cfg.Policy.Keys
+	block = nil
+	for _, t := range keys.AllowedTypes {
+		block = append(block, payloadRecord("key-allowed-type", t))
+	}
+	sorted(block)
+	if keys.MinRSABits != 0 {
+		lines = append(lines, payloadRecord("key-min-rsa-bits", strconv.Itoa(keys.MinRSABits)))
+	}
+	if keys.NoSharedKeys {
+		lines = append(lines, payloadRecord("key-no-shared-keys"))
+	}
+
+	for _, rule := range cfg.Policy.Access {
+		lines = append(lines, payloadRecord("access", rule.Pattern))
+		for _, user := range rule.DenyUsers {
+			lines = append(lines, payloadRecord("access-deny-user", rule.Pattern, user))
+		}
+		for _, group := range rule.DenyGroups {
+			lines = append(lines, payloadRecord("access-deny-group", rule.Pattern, group))
+		}
+		for _, user := range rule.RequireUsers {
+			lines = append(lines, payloadRecord("access-require-user", rule.Pattern, user))
+		}
+		for _, group := range rule.RequireGroups {
+			lines = append(lines, payloadRecord("access-require-group", rule.Pattern, group))
+		}
+		if rule.MaxReaders != 0 {
+			lines = append(lines, payloadRecord("access-max-readers", rule.Pattern, strconv.Itoa(rule.MaxReaders)))
+		}
+	}
+
+	lines = append(lines, rulesPayload("rule", cfg.Rules)...)
+	lines = append(lines, rulesPayload("writer", cfg.Writers)...)
+
+	for _, r := range cfg.RecoveryRecipients {
+		lines = append(lines, payloadRecord("recovery", payloadKey(r.Key)))
+		for _, pattern := range r.Exclude {
+			lines = append(lines, payloadRecord("recovery-exclude", payloadKey(r.Key), pattern))
+		}
+		for _, mode := range r.Modes {
+			lines = append(lines, payloadRecord("recovery-mode", payloadKey(r.Key), mode))
+		}
+	}
+
+	block = nil
+	for _, secret := range cfg.Secrets {
+		block = append(block, payloadRecord("secret", secret.Path))
+		for _, user := range secret.Users {
+			block = append(block, payloadRecord("secret-user", secret.Path, user))
+		}
+		for _, group := range secret.Groups {
+			block = append(block, payloadRecord("secret-group", secret.Path, group))
+		}
+		if secret.Mode != "" {
+			block = append(block, payloadRecord("secret-mode", secret.Path, secret.Mode))
+		}
+		if secret.Threshold != 0 {
+			block = append(block, payloadRecord("secret-threshold", secret.Path, strconv.Itoa(secret.Threshold)))
+		}
+	}
+	sorted(block)
+
+	if cfg.Filter {
+		lines = append(lines, payloadRecord("filter"))
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// rulesPayload encodes ownership rules as records of kind, in their order.
+func rulesPayload(kind string, rules []OwnershipRule) []string {
+	var lines []string
+	for _, rule := range rules {
+		lines = append(lines, payloadRecord(kind, rule.Pattern))
+		for _, user := range rule.Users {
+			lines = append(lines, payloadRecord(kind+"-user", rule.Pattern, user))
+		}
+		for _, group := range rule.Groups {
+			lines = append(lines, payloadRecord(kind+"-group", rule.Pattern, group))
+		}
+	}
+	return lines
+}
+
+func payloadRecord(kind string, fields ...string) string {
+	return strings.Join(append([]string{kind}, lo.Map(fields, func(f string, _ int) string {
+		return strconv.Quote(f)
+	})...), " ")
+}
+
+// payloadKey strips the comment of SSH keys.
+func payloadKey(key string) string {
+	if fields := strings.Fields(key); len(fields) > 2 && strings.HasPrefix(key, "ssh-") {
+		return fields[0] + " " + fields[1]
+	}
+	return key
+}
+
+// AdminKeys returns the SSH keys of admins, which can sign the config.
+func (cfg *Config) AdminKeys() []string {
+	return cfg.signingKeys(cfg.Admins)
+}
+
+// SignatureKey verifies the signature of the config, and returns the key
+// which made it.
+func (cfg *Config) SignatureKey() (ssh.PublicKey, error) {
+	if cfg.Signature == "" {
+		return nil, errConfigNotSigned
+	}
+
+	pub, err := sshVerify([]byte(cfg.Signature), configSigNamespace, cfg.signedPayload())
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature of %s, it may have been modified after signing: %v", defaultConfigFilename, err)
+	}
+	return pub, nil
+}
+
+// hasKey reports whether pub is one of keys.
+func hasKey(keys []string, pub ssh.PublicKey) bool {
+	fingerprint := ssh.FingerprintSHA256(pub)
+	return lo.ContainsBy(keys, func(key string) bool {
+		f, err := keyFingerprint(key)
+		return err == nil && f == fingerprint
+	})
+}
+
+func (ctx *Context) trustedAdminsPath() string {
+	return filepath.Join(ctx.RootDir, ".git", "agec", "admins")
+}
+
+// trustedAdmins returns the admin keys pinned by the last verified config, or
+// nil if no config has been verified yet.
+func (ctx *Context) trustedAdmins() ([]string, error) {
+	b, err := os.ReadFile(ctx.trustedAdminsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+func (ctx *Context) pinAdmins(keys []string) error {
+	path := ctx.trustedAdminsPath()
+	if len(keys) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(keys, "\n")+"\n"), 0o600)
+}
+
+// verifyConfig checks the config is signed by a trusted admin. Admin keys
+// pinned under .git/agec by `agec config sign` and `agec config verify` are
+// trusted, so a config can't declare new admins and vouch for itself. Until keys
+// are pinned, the admins of the config itself are trusted. It doesn't write
+// anything, as it runs for every command.
+func (ctx *Context) verifyConfig() error {
+	cfg := ctx.Config
+
+	pinned, err := ctx.trustedAdmins()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Admins) == 0 && pinned == nil {
+		return nil
+	}
+
+	pub, err := cfg.SignatureKey()
+	if err != nil {
+		return err
+	}
+
+	trusted := pinned
+	if pinned == nil {
+		trusted = cfg.AdminKeys()
+	}
+	if !hasKey(trusted, pub) {
+		return fmt.Errorf("%s is signed by %s, which is not a trusted admin key", defaultConfigFilename, ssh.FingerprintSHA256(pub))
+	}
+	return nil
+}
+
+// pinConfigAdmins pins the admin keys of the verified config, trusting them
+// on first use. A config with other admins, signed by a pinned key, moves the
+// pin to its admins.
+func (ctx *Context) pinConfigAdmins() error {
+	if ctx.ConfigTrustErr != nil {
+		return ctx.ConfigTrustErr
+	}
+
+	pinned, err := ctx.trustedAdmins()
+	if err != nil {
+		return err
+	}
+
+	admins := ctx.Config.AdminKeys()
+	if pinned == nil {
+		if len(admins) == 0 {
+			return nil
+		}
+		log.Printf("trusting admin keys of %s on first use", defaultConfigFilename)
+	} else if strings.Join(admins, "\n") == strings.Join(pinned, "\n") {
+		return nil
+	}
+	return ctx.pinAdmins(admins)
+}
+
+// checkConfigTrust returns an error unless the config is signed by a trusted
+// admin. With AGEC_ALLOW_UNSIGNED set, it only warns.
+func (ctx *Context) checkConfigTrust() error {
+	if ctx.ConfigTrustErr == nil {
+		return nil
+	}
+
+	if os.Getenv("AGEC_ALLOW_UNSIGNED") != "" {
+		log.Printf("WARNING: %v, its recipients may have been changed by someone other than an admin", ctx.ConfigTrustErr)
+		return nil
+	}
+	return fmt.Errorf("refusing to use recipients: %v. Ask an admin to review it and run `agec config sign`, or set AGEC_ALLOW_UNSIGNED=1", ctx.ConfigTrustErr)
+}
+
+// checkSignature finds a config which is not signed by a trusted admin.
+func checkSignature(ctx *Context) ([]checkProblem, error) {
+	if ctx.ConfigTrustErr == nil {
+		return nil, nil
+	}
+	return []checkProblem{{Path: defaultConfigFilename, Message: ctx.ConfigTrustErr.Error()}}, nil
+}
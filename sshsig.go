@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH signatures, as produced by `ssh-keygen -Y sign`.
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+
+const (
+	sshsigMagic   = "SSHSIG"
+	sshsigVersion = 1
+	sshsigHash    = "sha512"
+	sshsigPEMType = "SSH SIGNATURE"
+)
+
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+func sshsigMessage(namespace, hashAlgorithm string, message []byte) ([]byte, error) {
+	var h []byte
+	switch hashAlgorithm {
+	case "sha512":
+		sum := sha512.Sum512(message)
+		h = sum[:]
+	case "sha256":
+		sum := sha256.Sum256(message)
+		h = sum[:]
+	default:
+		return nil, fmt.Errorf("unsupported ssh signature hash %q", hashAlgorithm)
+	}
+
+	return append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     namespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          h,
+	})...), nil
+}
+
+// sshSign signs message with signer and returns an armored SSH signature.
+func sshSign(signer ssh.Signer, namespace string, message []byte) ([]byte, error) {
+	data, err := sshsigMessage(namespace, sshsigHash, message)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:       sshsigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: sshsigHash,
+		Signature:     ssh.Marshal(sig),
+	})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: sshsigPEMType, Bytes: blob}), nil
+}
+
+// sshVerify verifies the armored SSH signature over message, and returns the
+// public key which made it. Callers must check the key is trusted.
+func sshVerify(armored []byte, namespace string, message []byte) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != sshsigPEMType {
+		return nil, errors.New("malformed ssh signature")
+	}
+
+	if !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return nil, errors.New("malformed ssh signature")
+	}
+
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &blob); err != nil {
+		return nil, fmt.Errorf("malformed ssh signature: %v", err)
+	}
+	if blob.Version != sshsigVersion {
+		return nil, fmt.Errorf("unsupported ssh signature version %d", blob.Version)
+	}
+	if blob.Namespace != namespace {
+		return nil, fmt.Errorf("ssh signature namespace %q, expected %q", blob.Namespace, namespace)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("malformed ssh signature: %v", err)
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, errors.New("ssh-rsa signatures use SHA-1, which is not accepted")
+	}
+
+	data, err := sshsigMessage(namespace, blob.HashAlgorithm, message)
+	if err != nil {
+		return nil, err
+	}
+	if err := pub.Verify(data, &sig); err != nil {
+		return nil, fmt.Errorf("bad ssh signature: %v", err)
+	}
+	return pub, nil
+}
+
+// loadSigners returns SSH signers from identityFile, or, when it is empty,
+// from ssh-agent and unencrypted private keys in ~/.ssh.
+func loadSigners(identityFile string) ([]ssh.Signer, error) {
+	if identityFile != "" {
+		b, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if errors.As(err, new(*ssh.PassphraseMissingError)) {
+			return nil, fmt.Errorf("%q is protected by a passphrase, add it to ssh-agent instead", identityFile)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh private key %q: %v", identityFile, err)
+		}
+		return []ssh.Signer{signer}, nil
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if s, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, s...)
+			}
+		}
+	}
+
+	if homedir, err := os.UserHomeDir(); err == nil {
+		keyfiles, _ := os.ReadDir(filepath.Join(homedir, ".ssh"))
+		for _, keyfile := range keyfiles {
+			if keyfile.IsDir() {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(homedir, ".ssh", keyfile.Name()))
+			if err != nil {
+				continue
+			}
+			if signer, err := ssh.ParsePrivateKey(b); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil, errors.New("failed to load ssh keys from ssh-agent or ~/.ssh, specify identity file")
+	}
+	return signers, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+type textconvOpt struct {
+	IdentityFile string
+	File         string
+
+	ctx *Context
+}
+
+func runTextconv(opts *textconvOpt) error {
+	b, err := os.ReadFile(opts.File)
+	if err != nil {
+		return err
+	}
+
+	stanzas, err := readStanzas(bytes.NewReader(b))
+	if err != nil {
+		// not encrypted, show it as it is
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	// git passes a temporary file, so the secret can't be looked up
+	identities, _ := loadIdentities(opts.IdentityFile)
+	if plaintext, ok := decryptLayers(b, identities); ok {
+		_, err := os.Stdout.Write(plaintext)
+		return err
+	}
+
+	printHeaderSummary(os.Stdout, opts.ctx.Config, stanzas, len(b))
+	return nil
+}
+
+// decryptLayers decrypts ciphertext with identities, including the nested
+// layers of secrets which need a key of all of their owners.
+func decryptLayers(ciphertext []byte, identities []age.Identity) ([]byte, bool) {
+	if len(identities) == 0 {
+		return nil, false
+	}
+
+	out, err := decryptBytes(ciphertext, identities...)
+	if err != nil {
+		return nil, false
+	}
+	for bytes.HasPrefix(out, []byte(ageIntro+"\n")) {
+		out, err = decryptBytes(out, identities...)
+		if err != nil {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// printHeaderSummary prints the recipients and size of an encrypted file
+// which can't be decrypted, one per line so diffs show changed recipients.
+// SSH recipients are named after the users of cfg holding their key.
+func printHeaderSummary(w io.Writer, cfg *Config, stanzas []stanza, size int) {
+	owners := map[string]string{}
+	for _, u := range cfg.Users {
+		for _, key := range u.Keys() {
+			if tag, err := sshKeyTag(key); err == nil && tag != "" {
+				owners[tag] = u.Name
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "agec: encrypted file of %d bytes, none of your identities can decrypt it\n", size)
+	for _, s := range stanzas {
+		switch {
+		case (s.Type == "ssh-ed25519" || s.Type == "ssh-rsa") && len(s.Args) > 0:
+			owner, ok := owners[s.Args[0]]
+			if !ok {
+				owner = "unknown key"
+			} else {
+				owner = "user:" + owner
+			}
+			fmt.Fprintf(w, "recipient %s %s %s\n", s.Type, s.Args[0], owner)
+		default:
+			fmt.Fprintf(w, "recipient %s\n", s.Type)
+		}
+	}
+}
+
+func newTextconvCmd(ctx *Context) *cobra.Command {
+	opts := &textconvOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "textconv <file.age>",
+		Short: "Print the plaintext of an encrypted file for git diff",
+		Long: `Print the plaintext of an encrypted file, as the textconv driver of git diff
+set up by 'agec git setup'. If none of your identities can decrypt it, its
+recipients and size are printed instead, so diffs keep working for everyone.`,
+		Example: `  # show the plaintext of secrets in diffs
+  agec git setup
+  git log -p secret.txt.age`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+			opts.File = args[0]
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTextconv(opts)
+		},
+		ValidArgsFunction: EncryptedFileCompletion(ctx),
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&opts.IdentityFile, "identity", "i", os.Getenv("AGEC_IDENTITY"), "Specify identity file to decrypt file")
+
+	return cmd
+}
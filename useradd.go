@@ -8,7 +8,11 @@ import (
 	"os"
 	"strings"
 
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/samber/lo"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 type useraddOpt struct {
@@ -16,16 +20,41 @@ type useraddOpt struct {
 	Groups         []string
 	Recipients     []string
 	RecipientsFile string
+	Source         KeySource
 
 	ctx *Context
 }
 
 func runUseradd(opts *useraddOpt) error {
-	err := opts.ctx.Config.AddUser(opts.User, opts.Recipients)
+	err := opts.ctx.Config.CheckRevoked(opts.Recipients)
 	if err != nil {
 		return err
 	}
 
+	before, err := opts.ctx.Config.Clone()
+	if err != nil {
+		return err
+	}
+
+	err = opts.ctx.Config.AddUser(opts.User, opts.Recipients)
+	if err != nil {
+		return err
+	}
+
+	err = opts.ctx.Config.CheckKeyPolicy(opts.Recipients)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Source.IsZero() {
+		u, err := opts.ctx.Config.GetUser(opts.User)
+		if err != nil {
+			return err
+		}
+		u.Source = &opts.Source
+		opts.ctx.Config.SaveUser(u)
+	}
+
 	for _, group := range opts.Groups {
 		err := opts.ctx.Config.AddGroupMember(group, opts.User)
 		if err != nil {
@@ -33,6 +62,11 @@ func runUseradd(opts *useraddOpt) error {
 		}
 	}
 
+	err = opts.ctx.Config.CheckAccessPolicies(policyAffectedSecrets(before, opts.ctx.Config))
+	if err != nil {
+		return err
+	}
+
 	return opts.ctx.WriteConfigFile()
 }
 
@@ -44,7 +78,13 @@ func newUserAddCmd(ctx *Context) *cobra.Command {
 		Use:   "useradd",
 		Short: "Creates a new user with recipients read from stdin",
 		Example: `  # create user "aca" with public keys from github
-  curl -s "https://github.com/aca.keys" | agec useradd aca -R -`,
+  curl -s "https://github.com/aca.keys" | agec useradd aca -R -
+
+  # same as above, but keys can be updated later with "agec key sync"
+  agec useradd aca --github aca
+
+  # fetch keys from any URL, {user} is replaced by the user name
+  agec useradd aca --keys-url "https://keys.example.com/{user}.keys"`,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -52,27 +92,26 @@ func newUserAddCmd(ctx *Context) *cobra.Command {
 				return ErrConfigurationNotFound
 			}
 
+			opts.User = args[0]
+
 			var err error
-			switch opts.RecipientsFile {
-			case "":
-				return errors.New("specify recipients-file for the user")
-			case "-":
-				opts.Recipients, err = readRecipients(os.Stdin)
-				if err != nil {
-					return err
+			switch {
+			case !opts.Source.IsZero():
+				if opts.RecipientsFile != "" {
+					return errors.New("recipients-file can't be used with a key source")
 				}
-			default:
-				f, err := os.Open(opts.RecipientsFile)
-				if err != nil {
-					return err
-				}
-				opts.Recipients, err = readRecipients(f)
-				if err != nil {
+				if err := opts.Source.Validate(); err != nil {
 					return err
 				}
+				opts.Recipients, err = ctx.fetchKeys(opts.User, opts.Source)
+			case opts.RecipientsFile != "":
+				opts.Recipients, err = readRecipientsFile(opts.RecipientsFile)
+			default:
+				return errors.New("specify recipients-file or key source for the user")
+			}
+			if err != nil {
+				return err
 			}
-
-			opts.User = args[0]
 
 			return nil
 		},
@@ -88,19 +127,67 @@ func newUserAddCmd(ctx *Context) *cobra.Command {
 	f := cmd.Flags()
 	f.StringSliceVarP(&opts.Groups, "group", "g", nil, "Groups which the user is a member of")
 	f.StringVarP(&opts.RecipientsFile, "recipients-file", "R", "", "User's recipients, if set to -, the recipients are read from standard input.")
+	f.StringVar(&opts.Source.GitHub, "github", "", "Fetch recipients from keys of the GitHub user")
+	f.StringVar(&opts.Source.GitLab, "gitlab", "", "Fetch recipients from keys of the GitLab user")
+	f.StringVar(&opts.Source.URL, "keys-url", "", "Fetch recipients from the URL, {user} is replaced by the user name")
 	cmd.RegisterFlagCompletionFunc("group", GroupCompletion(ctx))
 
 	return cmd
 }
 
-func readRecipients(r io.Reader) (recs []string, err error) {
+// readRecipientsFile reads recipients from the file, or from standard input
+// if name is "-".
+func readRecipientsFile(name string) ([]string, error) {
+	if name == "-" {
+		return readRecipients(os.Stdin)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readRecipients(f)
+}
+
+// readRecipients reads public keys, one per line, and normalizes them with
+// normalizeRecipient. Keys with the same fingerprint are only kept once.
+func readRecipients(r io.Reader) ([]string, error) {
+	return scanRecipients(r, nil)
+}
+
+// scanRecipients is like readRecipients, but keys which fail to normalize are
+// skipped if skip returns true for their error.
+func scanRecipients(r io.Reader, skip func(err error) bool) (recs []string, err error) {
 	scanner := bufio.NewScanner(r)
+	fingerprints := map[string]bool{}
+
+	var n int
 	for scanner.Scan() {
-		line := scanner.Text()
+		n++
+		line := strings.TrimSpace(scanner.Text())
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
-		recs = append(recs, line)
+
+		rec, err := normalizeRecipient(line)
+		if err != nil && skip != nil && skip(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("malformed recipient at line %d: %v", n, err)
+		}
+
+		fingerprint, err := keyFingerprint(rec)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient at line %d: %v", n, err)
+		}
+		if fingerprints[fingerprint] {
+			continue
+		}
+		fingerprints[fingerprint] = true
+
+		recs = append(recs, rec)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -109,3 +196,68 @@ func readRecipients(r io.Reader) (recs []string, err error) {
 
 	return recs, nil
 }
+
+// authorizedKeysOptions are the options sshd accepts in authorized_keys.
+var authorizedKeysOptions = []string{
+	"agent-forwarding", "cert-authority", "command", "environment",
+	"expiry-time", "from", "no-agent-forwarding", "no-port-forwarding",
+	"no-pty", "no-touch-required", "no-user-rc", "no-x11-forwarding",
+	"permitlisten", "permitopen", "port-forwarding", "principals", "pty",
+	"restrict", "tunnel", "user-rc", "verify-required", "x11-forwarding",
+}
+
+// unsupportedKeyError is returned for SSH keys of types age can't encrypt to.
+type unsupportedKeyError struct {
+	Type string
+}
+
+func (e *unsupportedKeyError) Error() string {
+	return fmt.Sprintf("unsupported key type %q, only ssh-ed25519, ssh-rsa and age X25519 keys are supported", e.Type)
+}
+
+// normalizeRecipient parses a public key and returns it in canonical form.
+// Options of authorized_keys lines are stripped, the comment of SSH keys is
+// kept.
+func normalizeRecipient(line string) (string, error) {
+	// bech32 strings may also be all uppercase
+	if strings.HasPrefix(line, "AGE1") && strings.ToUpper(line) == line {
+		line = strings.ToLower(line)
+	}
+
+	if strings.HasPrefix(line, "age1") {
+		rec, err := age.ParseX25519Recipient(line)
+		if err != nil {
+			return "", err
+		}
+		return rec.String(), nil
+	}
+
+	pk, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", fmt.Errorf("unknown recipient type: %q", line)
+	}
+
+	for _, option := range options {
+		name, _, _ := strings.Cut(option, "=")
+		if !lo.Contains(authorizedKeysOptions, strings.ToLower(name)) {
+			return "", fmt.Errorf("%q is not an authorized_keys option, is it a known_hosts entry?", option)
+		}
+	}
+
+	switch pk.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA:
+	default:
+		return "", &unsupportedKeyError{Type: pk.Type()}
+	}
+
+	rec := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+	if comment != "" {
+		rec += " " + comment
+	}
+
+	if _, err := agessh.ParseRecipient(rec); err != nil {
+		return "", err
+	}
+
+	return rec, nil
+}
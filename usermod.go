@@ -1,8 +1,6 @@
 package main
 
 import (
-	"os"
-
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
@@ -25,8 +23,16 @@ func runUserMod(opts *userModOpt) error {
 		return err
 	}
 
+	before, err := config.Clone()
+	if err != nil {
+		return err
+	}
+
 	if len(opts.Recipients) != 0 {
-		u.Recipients = opts.Recipients
+		if err := config.CheckRevoked(opts.Recipients); err != nil {
+			return err
+		}
+		u.Recipients = u.replaceRecipients(opts.Recipients)
 	}
 
 	if len(opts.Groups) != 0 {
@@ -45,6 +51,17 @@ func runUserMod(opts *userModOpt) error {
 	}
 
 	ctx.Config.SaveUser(u)
+
+	if len(opts.Recipients) != 0 {
+		if err := config.CheckKeyPolicy(u.Keys()); err != nil {
+			return err
+		}
+	}
+
+	if err := config.CheckAccessPolicies(policyAffectedSecrets(before, config)); err != nil {
+		return err
+	}
+
 	return opts.ctx.WriteConfigFile()
 }
 
@@ -71,21 +88,9 @@ func newUserModCmd(ctx *Context) *cobra.Command {
 			}
 			opts.User = args[0]
 
-			switch opts.RecipientsFile {
-			case "":
-				break
-			case "-":
+			if opts.RecipientsFile != "" {
 				var err error
-				opts.Recipients, err = readRecipients(os.Stdin)
-				if err != nil {
-					return err
-				}
-			default:
-				f, err := os.Open(opts.RecipientsFile)
-				if err != nil {
-					return err
-				}
-				opts.Recipients, err = readRecipients(f)
+				opts.Recipients, err = readRecipientsFile(opts.RecipientsFile)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newUsersCmd(ctx *Context) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "users",
+		Short:         "Manage users in bulk",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(
+		newUsersSyncCmd(ctx),
+	)
+
+	return cmd
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+type usersSyncOpt struct {
+	From      string
+	DryRun    bool
+	Prune     bool
+	Reencrypt bool
+
+	ctx *Context
+}
+
+// keyDir is the users and group memberships declared in a directory of
+// public key files.
+type keyDir struct {
+	Users   map[string][]string
+	Members map[string][]string
+}
+
+// readKeyDir reads public keys from <dir>/<user>.pub, files in subdirectories
+// like <dir>/<group>/<user>.pub also make the user a member of the group.
+func readKeyDir(dir string) (*keyDir, error) {
+	kd := &keyDir{
+		Users:   map[string][]string{},
+		Members: map[string][]string{},
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || filepath.Ext(path) != ".pub" {
+			return nil
+		}
+
+		user := strings.TrimSuffix(d.Name(), ".pub")
+		keys, err := readRecipientsFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		kd.Users[user] = append(kd.Users[user], keys...)
+
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			group := filepath.Base(rel)
+			kd.Members[group] = lo.Uniq(append(kd.Members[group], user))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for user, keys := range kd.Users {
+		kd.Users[user] = lo.UniqBy(keys, func(key string) string {
+			fingerprint, _ := keyFingerprint(key)
+			return fingerprint
+		})
+	}
+	return kd, nil
+}
+
+func runUsersSync(opts *usersSyncOpt) error {
+	ctx := opts.ctx
+	cfg := ctx.Config
+
+	kd, err := readKeyDir(opts.From)
+	if err != nil {
+		return err
+	}
+
+	before, err := cfg.Clone()
+	if err != nil {
+		return err
+	}
+
+	var synced []string
+
+	users := lo.Keys(kd.Users)
+	sort.Strings(users)
+	for _, name := range users {
+		keys := kd.Users[name]
+		if err := cfg.CheckRevoked(keys); err != nil {
+			return fmt.Errorf("user %q: %v", name, err)
+		}
+		synced = append(synced, keys...)
+
+		u, err := cfg.GetUser(name)
+		if err != nil {
+			u = User{Name: name}
+		}
+		u.Recipients = u.replaceRecipients(keys)
+		cfg.SaveUser(u)
+	}
+
+	for _, u := range before.Users {
+		if _, ok := kd.Users[u.Name]; ok {
+			continue
+		}
+
+		if !opts.Prune {
+			log.Printf("user %q has no key file in %q, use --prune to remove it", u.Name, opts.From)
+			continue
+		}
+
+		if err := cfg.RemoveUser(u.Name); err != nil {
+			return err
+		}
+	}
+
+	groups := lo.Keys(kd.Members)
+	sort.Strings(groups)
+	for _, name := range groups {
+		members := kd.Members[name]
+		sort.Strings(members)
+
+		g, err := cfg.GetGroup(name)
+		if err != nil {
+			g = Group{Name: name}
+		}
+		g.Members = members
+		cfg.SaveGroup(g)
+	}
+
+	diff := configDiff(before, cfg)
+	if len(diff) == 0 {
+		fmt.Println("users are up to date")
+		return nil
+	}
+
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+
+	affected := affectedSecrets(before, cfg)
+	if opts.DryRun || !opts.Reencrypt {
+		printAffectedSecrets(affected)
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+
+	if err := cfg.CheckKeyPolicy(synced); err != nil {
+		return err
+	}
+
+	if err := cfg.CheckAccessPolicies(policyAffectedSecrets(before, cfg)); err != nil {
+		return err
+	}
+
+	if err := ctx.WriteConfigFile(); err != nil {
+		return err
+	}
+
+	if opts.Reencrypt {
+		return reencryptSecrets(ctx, affected)
+	}
+	return nil
+}
+
+func newUsersSyncCmd(ctx *Context) *cobra.Command {
+	opts := &usersSyncOpt{
+		ctx: ctx,
+	}
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Sync users and groups from a directory of public key files",
+		Long: `Sync users and groups from a directory of public key files.
+
+Each <user>.pub file declares a user with the public keys in the file. Files
+in subdirectories, like devops/<user>.pub, also make the user a member of the
+group named after the directory. Memberships of those groups are replaced by
+the files in the directory, other groups are left untouched.`,
+		Example: `  # show changes without applying them
+  agec users sync --from keys/ --dry-run
+
+  # apply changes, remove users without a key file and re-encrypt secrets
+  agec users sync --from keys/ --prune --reencrypt`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if ctx == nil {
+				return ErrConfigurationNotFound
+			}
+
+			if opts.From == "" {
+				return fmt.Errorf("specify directory of public key files with --from")
+			}
+
+			fi, err := os.Stat(opts.From)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf("%q is not a directory", opts.From)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUsersSync(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&opts.From, "from", "", "Directory of public key files")
+	f.BoolVarP(&opts.DryRun, "dry-run", "n", false, "Only show changes")
+	f.BoolVar(&opts.Prune, "prune", false, "Remove users without a key file")
+	f.BoolVar(&opts.Reencrypt, "reencrypt", false, "Re-encrypt secrets whose recipients have changed")
+	cmd.MarkFlagDirname("from")
+
+	return cmd
+}
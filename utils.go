@@ -66,7 +66,11 @@ func newGroupsCmd(ctx *Context) *cobra.Command {
 			} else {
 				user := args[0]
 				for _, g := range ctx.Config.Groups {
-					if lo.Contains(g.Members, user) {
+					members, err := ctx.Config.GroupMembers(g.Name)
+					if err != nil {
+						return err
+					}
+					if lo.Contains(members, user) {
 						fmt.Println(g.Name)
 					}
 				}